@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// classifyCreate makes a best-effort guess at whether a file was moved into the directory or opened there.
+// fsnotify reports both inotify IN_CREATE and IN_MOVED_TO as Create, so this infers the kind from the file:
+// a rename changes a file's ctime but not its mtime, while a newly opened file has matching times.
+// The guess can be wrong: on a filesystem with coarse timestamps, a file moved in soon after its last write
+// has matching times, and a file written to again before the stat looks opened. The kind is only logged.
+func classifyCreate(name string) createKind {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return createUnknown
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return createUnknown
+	}
+	if st.Ctim.Nano() > st.Mtim.Nano() {
+		return createMovedIn
+	}
+	return createOpened
+}
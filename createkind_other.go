@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// classifyCreate cannot tell how a file was created on this platform
+func classifyCreate(name string) createKind {
+	return createUnknown
+}
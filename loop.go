@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// watchLoop watches a directory drain over and over, as a long-running service. Each time the directory is
+// empty it waits for files to arrive, then watches them drain and emits a record of the cycle, numbered from 1.
+// Each cycle gets its own options from newOpts.
+//
+// The deadline applies to each drain, or with runDeadline to the whole run, including the waits for files.
+// The loop ends when ctx is done, when the run deadline passes while waiting for files, or after emitting
+// a cycle that did not drain. It returns only the errors from emit.
+func watchLoop(ctx context.Context, dirName string, newOpts func() *options, runDeadline bool,
+	emit func(JSONResult) error) error {
+	runStart := time.Now()
+	// remaining sets opts.deadline to what is left of the run deadline, reporting false if none is left
+	remaining := func(opts *options) bool {
+		if !runDeadline || opts.noDeadline {
+			return true
+		}
+		opts.deadline -= time.Since(runStart)
+		return opts.deadline > 0
+	}
+
+	for cycle := 1; ctx.Err() == nil; cycle++ {
+		// Wait for files to arrive, with no deadline unless the deadline covers the whole run
+		fill := newOpts()
+		if !runDeadline {
+			fill.noDeadline = true
+		}
+		if !remaining(fill) {
+			return nil
+		}
+		d, err := newDir(dirName, fill)
+		if err == nil && d.isEmpty() {
+			stop := context.AfterFunc(ctx, d.Stop)
+			_, _, err = d.watchChange(fill)
+			stop()
+		}
+		switch {
+		case errors.Is(err, ErrCanceled), runDeadline && errors.Is(err, ErrTimeout):
+			return nil
+		case err != nil:
+			res := summarize(dirName, d, errResult(err), fill, time.Now())
+			res.Cycle = cycle
+			return emit(res)
+		}
+
+		// Watch the files drain
+		opts := newOpts()
+		start := time.Now()
+		var res result
+		if !remaining(opts) {
+			res = errResult(ErrTimeout)
+		} else if d, err = newDir(dirName, opts); err != nil {
+			res = errResult(err)
+		} else {
+			stop := context.AfterFunc(ctx, d.Stop)
+			res = d.watch(opts)
+			stop()
+		}
+		if errors.Is(res.err, ErrCanceled) {
+			return nil
+		}
+		s := summarize(dirName, d, res, opts, start)
+		checkEmptyDir(&s, opts)
+		s.Cycle = cycle
+		if err := emit(s); err != nil || !res.drained {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchLoop(t *testing.T) {
+	testPath := createPath(t)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		newOpts := func() *options {
+			return newTestOptions(t, (1 * time.Minute), 0, false)
+		}
+		var records []JSONResult
+		err := watchLoop(ctx, testPath, newOpts, false, func(res JSONResult) error {
+			if records = append(records, res); len(records) == 2 {
+				cancel()
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("Did not get expected result. Wanted: %d cycles, got: %d", 2, len(records))
+		}
+		for i, res := range records {
+			if res.Cycle != i+1 || !res.Drained || res.Reason != reasonDrained {
+				t.Errorf("Unexpected result. Wanted cycle %d drained, got: %+v", i+1, res)
+			}
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// Fill and drain the directory twice
+		for cycle := 0; cycle < 2; cycle++ {
+			time.Sleep(100 * time.Millisecond)
+			files := []*os.File{createTempFile(t, testPath), createTempFile(t, testPath)}
+			time.Sleep(50 * time.Millisecond)
+			for _, f := range files {
+				if err := os.Remove(f.Name()); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	})
+}
+
+func TestWatchLoopRunDeadline(t *testing.T) {
+	testPath := createPath(t)
+	newOpts := func() *options {
+		return newTestOptions(t, (100 * time.Millisecond), 0, false)
+	}
+	// The run deadline passes while waiting for files, which ends the loop without a failed cycle
+	start := time.Now()
+	err := watchLoop(context.Background(), testPath, newOpts, true, func(res JSONResult) error {
+		t.Errorf("Unexpected result. Wanted no cycles, got: %+v", res)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Unexpected result. Wanted the loop to end at the run deadline, got: %s", elapsed)
+	}
+}
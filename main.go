@@ -1,50 +1,434 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+// Build metadata, set with -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
 func main() {
 	deadline := flag.Duration("deadline", (5 * time.Minute), "Set a time to stop watching a directory "+
-		"draining of files.")
+		"draining of files. Must be greater than zero unless -no-deadline is set.")
+	extendOnProgress := flag.Bool("extend-on-progress", false, "Extend the deadline by -extend-by each time "+
+		"the file count drops by -extend-fraction, up to -max-deadline")
+	extendFraction := flag.Float64("extend-fraction", 0.1, "Set the fraction of remaining files that must drain "+
+		"to extend the deadline")
+	extendBy := flag.Duration("extend-by", time.Minute, "Set how much to extend the deadline on progress")
+	maxDeadline := flag.Duration("max-deadline", time.Hour, "Set the latest an extended deadline can be")
+	maxRuntime := flag.Duration("max-runtime", 0, "Stop watching a directory with an error once it has been "+
+		"watched this long, even while files are draining and whatever the deadline. 0 means no limit.")
+	noDeadline := flag.Bool("no-deadline", false, "Watch a directory until it drains with no deadline")
 	eventMonitor := flag.Uint("eventMonitor", 0, "Set a file creation monitor threshold to stop"+
 		" watching a directory when file create events exceed remove events by a threshold:"+
 		"\nthreshold = create events - remove events\n"+
 		"Increase to allow more file creation activity while watching. The lowest threshold is 1.")
+	thresholdWarmup := flag.Duration("threshold-warmup", 0, "Hold off the -eventMonitor threshold for this long "+
+		"from the start, so a burst of creates ahead of the first removes does not stop the watch. After the warmup "+
+		"the threshold applies to the net creates past those made during it. 0 means no warmup.")
+	thresholdPct := flag.Float64("threshold-pct", 0, "Stop watching a directory when its file count grows this "+
+		"many percent past the starting count. If -eventMonitor is also set, whichever threshold is crossed first "+
+		"stops the watch. It does not apply to a directory that starts empty, and the ceiling it sets is capped "+
+		"at the largest file count, 4294967295. 0 means no percentage threshold.")
+	removed := flag.Uint64("removed", 0, "Report the directory drained once this many files have been removed, "+
+		"whatever is left in it. 0 means wait for the directory to empty.")
+	ops := flag.String("ops", "create,remove", "Count these comma-separated event operations: create, remove, "+
+		"and rename. An allowed rename counts as a remove.")
+	maxFiles := flag.Uint("max-files", 0, "Set a maximum file count. Stop with an error if the directory holds more "+
+		"files at the start or while watching. 0 means no maximum.")
+	ext := flag.String("ext", "", "Only count files with these comma-separated extensions, e.g. gz,csv. "+
+		"Leading dots are optional.")
+	ownerOnly := flag.Bool("owner-only", false, "Only count files owned by the current user, treating other "+
+		"users' files as absent. Unix only.")
+	derefSymlinks := flag.Bool("deref-symlinks", false, "Count a symlink by what it points to, so a symlink to a "+
+		"directory is not counted. By default symlinks count as files. Dangling symlinks always count as files.")
+	olderThan := flag.Duration("older-than", 0, "Only count files last modified more than this long ago, so "+
+		"newly arriving files are ignored until they age past it. The directory is re-read every tenth of this, "+
+		"up to a minute, for files that have aged. A counted file written to again leaves the count until it ages "+
+		"again, without counting as removed. 0 counts files of any age.")
+	extCaseSensitive := flag.Bool("ext-case-sensitive", false, "Match -ext extensions case-sensitively")
+	files := flag.String("files", "", "Only count these comma-separated file names, e.g. a.done,b.done. "+
+		"Named files missing at the start are already drained.")
+	poll := flag.Duration("poll", 0, "Poll the directory file count at this interval instead of watching for "+
+		"file events. 0 means watch for events.")
+	mtimeStable := flag.Duration("mtime-stable", 0, "Report the directory settled once its own modification "+
+		"time has not advanced for this long, whatever its file count, instead of watching files drain. "+
+		"The directory is stat'd every -poll, or every tenth of this window but at most once a millisecond. "+
+		"0 means watch for a drain.")
+	confirm := flag.Uint("confirm", 1, "Set the number of consecutive polls that must find the directory empty "+
+		"before it is reported drained")
+	minRate := flag.Float64("min-rate", 0, "Stop watching when files are removed more slowly than this many "+
+		"files per second, measured over each -min-rate-window. 0 means no minimum.")
+	rateWindow := flag.Duration("min-rate-window", (30 * time.Second), "Set the window the -min-rate is "+
+		"measured over")
+	rateWarmup := flag.Duration("min-rate-warmup", (30 * time.Second), "Wait this long before measuring the "+
+		"first -min-rate-window, so removals that are slow to start do not stop the watch. 0 means no warm-up.")
+	setupTimeout := flag.Duration("setup-timeout", (30 * time.Second), "Set a time limit for starting to watch "+
+		"the directory. 0 means no limit.")
+	loop := flag.Bool("loop", false, "Run as a service: after a single directory drains, wait for the next files "+
+		"to arrive and watch them drain, printing a result per cycle, until interrupted or a cycle does not drain")
+	loopRunDeadline := flag.Bool("loop-run-deadline", false, "With -loop, apply -deadline to the whole run "+
+		"rather than to each drain")
+	watchCheck := flag.Duration("watch-check", 0, "Check that the directory is still watched after this long "+
+		"without events, stopping with an error if the watch was lost while files remain. 0 means no check.")
+	untilChange := flag.Bool("until-change", false, "Watch a single directory until its file count goes up or "+
+		"down, then print the new count")
+	recursive := flag.Bool("recursive", false, "Count and watch files in subdirectories too. Subdirectories "+
+		"that cannot be read are skipped.")
+	prune := flag.String("prune", "", "With -recursive, skip subdirectories and files whose names match these "+
+		"comma-separated patterns, e.g. .git,tmp,*.cache. Nothing beneath a skipped subdirectory is counted or watched.")
+	trackComplete := flag.Bool("track-complete", false, "Re-stat files on write and chmod events to track "+
+		"complete files: a file is complete while it is non-empty, and truncating it to zero bytes makes it "+
+		"incomplete again. The count of complete files is logged with -v and reported with -json.")
+	baseline := flag.Bool("baseline", false, "Only wait for the files present at the start to be removed. "+
+		"Files that arrive later never hold up the drain, though they still count toward -eventMonitor.")
+	requireEmptyDir := flag.Bool("require-empty-dir", false, "Once a directory drains of files, check that it holds "+
+		"no entries at all, including subdirectories and files that were not counted, and report whether it is "+
+		"removable. The exit status still only reports the drain, so check removable in the result.")
+	removeDir := flag.Bool("remove-dir", false, "With -require-empty-dir, remove each directory found removable")
+	checkWritable := flag.Bool("check-writable", false, "Before watching, warn if this process lacks the write "+
+		"and search permission on the directory needed to remove files from it")
+	strictPreflight := flag.Bool("strict-preflight", false, "With -check-writable, fail instead of warning")
+	ordered := flag.Bool("ordered", false, "With -v, warn when a file is removed while a file that sorts before "+
+		"it is still present, for queue directories of sequence-numbered files that should drain in order")
+	listInitial := flag.Bool("list-initial", false, "Print the files counted at the start to stderr, and "+
+		"list them as initial_files with -json")
+	rewatch := flag.Bool("rewatch", false, "If the directory is removed or renamed, watch the directory that "+
+		"replaces it at the same path instead of stopping with an error")
+	removeConfirm := flag.Duration("remove-confirm", 0, "Hold each remove event back this long and re-stat the "+
+		"file, only counting the remove if the file is still gone. This keeps atomic saves from changing the count. "+
+		"Other events are counted meanwhile.")
+	requireFiles := flag.Duration("require-files", 0, "If the directory starts empty, wait this long for files "+
+		"to arrive and stop with an error if none do, rather than reporting it drained. 0 means files are not required.")
+	minDuration := flag.Duration("min-duration", 0, "Watch for at least this long before reporting a drain, "+
+		"even if the directory starts empty or empties sooner")
 	verbose := flag.Bool("v", false, "Log file create and remove events")
+	debug := flag.Bool("debug", false, "Log every raw watcher event, including writes and chmods that are not counted")
+	verboseStat := flag.Bool("v-stat", false, "Log file create and remove events with file size, mode, and modification time")
+	noColor := flag.Bool("no-color", false, "Do not color event logs. Color is also off when NO_COLOR is set or "+
+		"stderr is not a terminal.")
+	showStatus := flag.Bool("status-line", false, "Show a live status line with the file count and elapsed "+
+		"time while watching a single directory, when stderr is a terminal. Ignored with -v.")
+	quiet := flag.Bool("q", false, "Only print failures, to stderr")
+	silent := flag.Bool("silent", false, "Print nothing at all, not even errors, and report only through the exit "+
+		"status: 0 if every directory drained, 1 on a timeout, 2 for invalid flags, 3 if the -threshold or "+
+		"-max-files limit was crossed, and 4 for any other error, such as a missing directory. Over multiple "+
+		"directories the highest status wins.")
+	rawOutput := flag.Bool("raw-output", false, "Print durations and counts in results exactly, e.g. 2m3.456s and "+
+		"1204, for machine parsing, rather than formatted for people, e.g. 2m3s and 1,204 files")
+	record := flag.String("record", "", "Record every raw watcher event of a single-directory watch to this file, "+
+		"as JSON lines, for -replay")
+	replay := flag.String("replay", "", "Replay a -record file, counting its events in place of watching a "+
+		"directory, and print the result")
+	printVersion := flag.Bool("version", false, "Print the version, commit, and build date, then exit")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Watch at most this many directories at once, starting the "+
+		"rest as others finish. 0 watches them all at once.")
+	glob := flag.Bool("glob", false, "Treat each directory argument as a glob pattern, e.g. '/spool/batch-*', "+
+		"and watch every directory it matches")
+	jsonStream := flag.Bool("json-stream", false, "Watching a single directory, print JSON lines as it drains "+
+		"each tenth of its files, nears the -eventMonitor threshold, and every -json-stream-interval, ending with "+
+		"the JSON result marked \"final\":true")
+	streamInterval := flag.Duration("json-stream-interval", (10 * time.Second), "Set how often -json-stream "+
+		"prints a progress line")
+	jsonOut := flag.Bool("json", false, "Print the result as JSON, or a JSON array for multiple directories")
 
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
-		fmt.Fprintf(w, "Usage:\n %s [options] <dir>\n", os.Args[0])
+		fmt.Fprintf(w, "Usage:\n %s [options] <dir> [<dir>...]\n", os.Args[0])
+		fmt.Fprintf(w, "Each option's default can be set with a %s environment variable, e.g. %s=10m.\n",
+			envPrefix, envName("deadline"))
 		flag.PrintDefaults()
 	}
+	// -silent also covers errors in the flags themselves, so it is looked for before they are parsed
+	if silentRequested(flag.CommandLine, os.Args[1:]) {
+		flag.CommandLine.SetOutput(io.Discard)
+	}
+	if err := applyEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(exitUsage)
+	}
 	flag.Parse()
 
+	// Everything main prints goes to stdout and stderr, and everything logged goes to logger, which -silent discards
+	stdout, stderr, logger := io.Writer(os.Stdout), io.Writer(os.Stderr), log.Default()
+	if *silent {
+		stdout, stderr, logger = io.Discard, io.Discard, log.New(io.Discard, "", 0)
+	}
+
+	if *printVersion {
+		fmt.Fprintf(stdout, "watchdrain %s commit:%s built:%s\n", version, commit, date)
+		os.Exit(0)
+	}
+	prunePatterns, err := parsePrune(*prune)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(exitUsage)
+	}
+	countOps, err := parseOps(*ops)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(exitUsage)
+	}
+	if *ownerOnly && !ownerOnlySupported {
+		fmt.Fprintln(stderr, "-owner-only is not supported on this platform")
+		os.Exit(exitUsage)
+	}
+	if *removeDir && *loop {
+		fmt.Fprintln(stderr, "-remove-dir cannot be used with -loop, which watches the directory again")
+		os.Exit(exitUsage)
+	}
+	dirs := flag.Args()
+	if *glob {
+		if dirs, err = expandGlobs(dirs, logger); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitUsage)
+		}
+	}
+	// These watch a single directory, and would be ignored over several
+	if len(dirs) > 1 {
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{{"-loop", *loop}, {"-record", *record != ""}, {"-json-stream", *jsonStream}, {"-status-line", *showStatus}} {
+			if f.set {
+				fmt.Fprintf(stderr, "%s cannot be used with more than one directory\n", f.name)
+				os.Exit(exitUsage)
+			}
+		}
+	}
+
+	// Each watched directory needs its own options, since they carry the eventCh channel
+	buildOpts := func() (*options, error) {
+		opts, err := newOptions(*deadline, *eventMonitor, *verbose)
+		if err != nil {
+			return nil, err
+		}
+		opts.noDeadline = *noDeadline
+		opts.maxRuntime = *maxRuntime
+		opts.removedGoal = *removed
+		opts.thresholdPct = *thresholdPct
+		opts.thresholdWarmup = *thresholdWarmup
+		opts.extendOnProgress = *extendOnProgress
+		opts.extendFraction = *extendFraction
+		opts.extendBy = *extendBy
+		opts.maxDeadline = *maxDeadline
+		opts.verboseStat = *verboseStat
+		opts.color = useColor(os.Stderr, *noColor)
+		opts.maxFiles = *maxFiles
+		opts.exts = parseExts(*ext)
+		opts.extCaseSensitive = *extCaseSensitive
+		opts.names = parseNames(*files)
+		if *ownerOnly {
+			opts.countIf = ownedByCurrentUser
+		}
+		opts.derefSymlinks = *derefSymlinks
+		opts.olderThan = *olderThan
+		opts.poll = *poll
+		opts.mtimeStable = *mtimeStable
+		opts.confirm = *confirm
+		opts.minRate = *minRate
+		opts.rateWindow = *rateWindow
+		opts.rateWarmup = *rateWarmup
+		opts.setupTimeout = *setupTimeout
+		opts.watchCheck = *watchCheck
+		opts.recursive = *recursive
+		opts.prune = prunePatterns
+		opts.ops = countOps
+		opts.trackComplete = *trackComplete
+		opts.rewatch = *rewatch
+		opts.listInitial = *listInitial
+		opts.ordered = *ordered
+		opts.baseline = *baseline
+		opts.requireEmptyDir = *requireEmptyDir
+		opts.removeDir = *removeDir
+		opts.checkWritable = *checkWritable
+		opts.strictPreflight = *strictPreflight
+		opts.minDuration = *minDuration
+		opts.requireFiles = *requireFiles
+		opts.debug = *debug
+		opts.removeConfirm = *removeConfirm
+		opts.rawOutput = *rawOutput
+		opts.logger = logger
+		return opts, opts.validate()
+	}
+	if _, err := buildOpts(); err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(exitUsage)
+	}
+	// The options were validated above, and every directory is built from the same flags
+	newOpts := func() *options {
+		opts, _ := buildOpts()
+		return opts
+	}
+
+	// An interrupt stops the watches in progress, which are reported canceled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// SIGUSR1 dumps the paths being watched, with their file counts, to stderr
+	dump := make(chan os.Signal, 1)
+	notifyWatchDump(dump)
+	go func() {
+		for range dump {
+			dumpWatches(stderr)
+		}
+	}()
+
 	switch {
-	case len(flag.Args()) == 1:
-		dir := flag.Arg(0)
-		d, err := newDir(dir)
+	case *replay != "":
+		f, err := os.Open(*replay)
 		if err != nil {
-			fmt.Fprint(os.Stderr, err)
-			os.Exit(1)
-		}
-		opts := newOptions(*deadline, *eventMonitor, *verbose)
-		watch, err := d.watchDrain(opts)
-		if errors.Is(err, ErrTimeout) {
-			fmt.Fprintf(os.Stderr, "%s: %s after %s\n", dir, err, deadline)
-			os.Exit(1)
-		} else if err != nil {
-			fmt.Fprintf(os.Stderr, "%s: %s\n", dir, err)
-			os.Exit(1)
-		}
-		fmt.Fprintf(os.Stdout, "%s drained:%t\n", dir, watch)
-		os.Exit(0)
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitError)
+		}
+		res := replayOne(f, newOpts())
+		f.Close()
+		if err := printResult(stdout, stderr, res, *jsonOut, *verbose || *verboseStat, *quiet, *rawOutput); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitError)
+		}
+		os.Exit(exitCode([]JSONResult{res}))
+	case *loop && len(dirs) == 1:
+		code := exitDrained
+		err := watchLoop(ctx, dirs[0], newOpts, *loopRunDeadline, func(res JSONResult) error {
+			code = max(code, exitCode([]JSONResult{res}))
+			return printResult(stdout, stderr, res, *jsonOut, *verbose || *verboseStat, *quiet, *rawOutput)
+		})
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitError)
+		}
+		os.Exit(code)
+	case *untilChange && len(dirs) == 1:
+		res := watchOneChange(ctx, dirs[0], newOpts())
+		if err := printResult(stdout, stderr, res, *jsonOut, *verbose || *verboseStat, *quiet, *rawOutput); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitError)
+		}
+		os.Exit(exitCode([]JSONResult{res}))
+	case len(dirs) == 1:
+		opts := newOpts()
+		opts.status = statusLine(os.Stderr, *showStatus && !*silent && !*verbose && !*verboseStat && !*debug)
+		if *jsonStream {
+			opts.stream = stdout
+			opts.streamInterval = *streamInterval
+		}
+		if err := opts.validate(); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitUsage)
+		}
+		var recording *os.File
+		if *record != "" {
+			if recording, err = os.Create(*record); err != nil {
+				fmt.Fprintln(stderr, err)
+				os.Exit(exitError)
+			}
+			opts.record = newRecorder(recording, opts.logger)
+		}
+		res := watchOne(ctx, dirs[0], opts)
+		if recording != nil {
+			recording.Close()
+		}
+		// A stream always ends with its final result, even with -q
+		res.Final = *jsonStream
+		if err := printResult(stdout, stderr, res, *jsonOut || *jsonStream, *verbose || *verboseStat,
+			*quiet && !*jsonStream, *rawOutput); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitError)
+		}
+		os.Exit(exitCode([]JSONResult{res}))
+	case len(dirs) > 1 && !*untilChange:
+		summaries, _ := WatchDrainAll(ctx, dirs, newOpts, *maxConcurrent)
+		if err := printSummaries(stdout, stderr, summaries, *jsonOut, *quiet, *rawOutput); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(exitError)
+		}
+		os.Exit(exitCode(summaries))
 	default:
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+}
+
+// envPrefix starts the names of the environment variables that set option defaults
+const envPrefix = "WATCHDRAIN_"
+
+// envNames holds the environment variables for flags whose names do not read well as one
+var envNames = map[string]string{
+	"eventMonitor": envPrefix + "THRESHOLD",
+	"v":            envPrefix + "VERBOSE",
+	"q":            envPrefix + "QUIET",
+}
+
+// envExcluded holds the flags that are actions or modes rather than option defaults, which the environment
+// does not set. Their variable names, such as WATCHDRAIN_VERSION, are also likely to be set for other reasons.
+var envExcluded = map[string]bool{"version": true, "replay": true, "record": true, "silent": true, "debug": true}
+
+// envName returns the environment variable for a flag, e.g. WATCHDRAIN_MAX_FILES for -max-files
+func envName(flagName string) string {
+	if name, ok := envNames[flagName]; ok {
+		return name
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// silentRequested reports whether -silent is set on the command line, before the flags of fs are parsed.
+// It steps over flag values as parsing does, and stops where parsing would, at the first argument that is not a flag.
+func silentRequested(fs *flag.FlagSet, args []string) bool {
+	silent := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		switch f := fs.Lookup(name); {
+		case name == "silent":
+			silent = true
+			if hasValue {
+				silent, _ = strconv.ParseBool(value)
+			}
+		case f != nil && !hasValue && !isBoolFlag(f):
+			i++ // The next argument is the flag's value
+		}
 	}
+	return silent
+}
+
+// isBoolFlag reports whether a flag is a boolean, which takes no separate value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// applyEnv sets flags from their environment variables. It runs before the command line is parsed,
+// so the environment sets defaults and flags on the command line override them. The envExcluded flags are skipped.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if envExcluded[f.Name] {
+			return
+		}
+		value, ok := lookup(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), setErr)
+		}
+	})
+	return err
 }
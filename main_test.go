@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersion(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "watchdrain")
+	ldflags := "-X main.version=v1.2.3 -X main.commit=abc123 -X main.date=2024-01-02T03:04:05Z"
+	if out, err := exec.Command("go", "build", "-ldflags", ldflags, "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	out, err := exec.Command(bin, "-version").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "watchdrain v1.2.3 commit:abc123 built:2024-01-02T03:04:05Z\n"
+	if got := string(out); got != want {
+		t.Errorf("Unexpected result. Wanted: %q, got: %q", want, got)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"WATCHDRAIN_DEADLINE":  "10m",
+		"WATCHDRAIN_MAX_FILES": "50",
+		"WATCHDRAIN_VERBOSE":   "true",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	fs := flag.NewFlagSet("watchdrain", flag.ContinueOnError)
+	deadline := fs.Duration("deadline", 5*time.Minute, "")
+	maxFiles := fs.Uint("max-files", 0, "")
+	verbose := fs.Bool("v", false, "")
+	if err := applyEnv(fs, lookup); err != nil {
+		t.Fatal(err)
+	}
+	// The command line wins over the environment
+	if err := fs.Parse([]string{"-deadline", "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	if *deadline != time.Minute {
+		t.Errorf("Unexpected result. Wanted: %s, got: %s", time.Minute, *deadline)
+	}
+	if *maxFiles != 50 {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", 50, *maxFiles)
+	}
+	if !*verbose {
+		t.Errorf("Unexpected result. Wanted: %t, got: %t", true, *verbose)
+	}
+
+	// Actions and modes are not set from the environment, whose variables may mean something else
+	env["WATCHDRAIN_VERSION"] = "1.4.2"
+	version := fs.Bool("version", false, "")
+	if err := applyEnv(fs, lookup); err != nil || *version {
+		t.Errorf("Unexpected result. Wanted WATCHDRAIN_VERSION ignored, got: %t, %v", *version, err)
+	}
+
+	env["WATCHDRAIN_DEADLINE"] = "soon"
+	err := applyEnv(fs, lookup)
+	if err == nil || !strings.Contains(err.Error(), "WATCHDRAIN_DEADLINE") {
+		t.Errorf("Unexpected result. Wanted an error naming WATCHDRAIN_DEADLINE, got: %v", err)
+	}
+}
+
+func TestSilent(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "watchdrain")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+	drainPath := createPath(t)
+	stuckPath := createPath(t)
+	createSeedFiles(t, stuckPath)
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{"Drained", []string{"-silent", drainPath}, 0},
+		{"Timeout", []string{"-silent", "-v", "-list-initial", "-deadline", "100ms", stuckPath}, 1},
+		{"Usage", []string{"-deadline", "soon", "-silent", drainPath}, 2},
+		{"ZeroDeadline", []string{"-deadline", "0", "-silent", drainPath}, 2},
+		{"LoopDirs", []string{"-silent", "-loop", drainPath, stuckPath}, 2},
+		{"JSONStreamDirs", []string{"-silent", "-json-stream", drainPath, stuckPath}, 2},
+		{"Error", []string{"-silent", filepath.Join(drainPath, "missing")}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command(bin, tt.args...)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			err := cmd.Run()
+			code := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("Did not get expected result. Wanted exit code: %d, got: %d", tt.wantCode, code)
+			}
+			if stdout.Len() != 0 || stderr.Len() != 0 {
+				t.Errorf("Unexpected output. Wanted none, got stdout: %q, stderr: %q", stdout.String(), stderr.String())
+			}
+		})
+	}
+}
+
+func TestSilentRequested(t *testing.T) {
+	fs := flag.NewFlagSet("watchdrain", flag.ContinueOnError)
+	fs.Bool("silent", false, "")
+	fs.Bool("v", false, "")
+	fs.Duration("deadline", 5*time.Minute, "")
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"-silent", "dir"}, true},
+		{[]string{"--silent=true", "dir"}, true},
+		{[]string{"-deadline", "soon", "-silent"}, true},
+		{[]string{"-silent=false", "dir"}, false},
+		{[]string{"dir", "-silent"}, false},
+		{[]string{"--", "-silent"}, false},
+		{[]string{"-v", "-silent"}, true},
+		{[]string{"-deadline", "-silent", "dir"}, false},
+	}
+	for _, tt := range tests {
+		if got := silentRequested(fs, tt.args); got != tt.want {
+			t.Errorf("Unexpected result for %q. Wanted: %t, got: %t", tt.args, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "sort"
+
+// fileQueue holds the counted files, sorted by path, for checking that files are removed in order
+type fileQueue []string
+
+// add inserts a file, if it is not already held
+func (q *fileQueue) add(name string) {
+	i := sort.SearchStrings(*q, name)
+	if i < len(*q) && (*q)[i] == name {
+		return
+	}
+	*q = append(*q, "")
+	copy((*q)[i+1:], (*q)[i:])
+	(*q)[i] = name
+}
+
+// remove takes out a file and returns the first file still held that sorts before it, if any, which
+// was skipped over. A file that is not held was never counted, so it is not out of order.
+func (q *fileQueue) remove(name string) (skipped string, outOfOrder bool) {
+	i := sort.SearchStrings(*q, name)
+	if i == len(*q) || (*q)[i] != name {
+		return "", false
+	}
+	*q = append((*q)[:i], (*q)[i+1:]...)
+	if i > 0 {
+		return (*q)[0], true
+	}
+	return "", false
+}
+
+// checkOrder tracks a counted event against the queue when checking removal order, logging a warning with -v
+// when a file is removed while one that sorts before it is still there. It never changes the count.
+func (d *dir) checkOrder(name string, ev event, opt *options) {
+	if ev == Create {
+		d.queue.add(name)
+		return
+	}
+	if skipped, outOfOrder := d.queue.remove(name); outOfOrder && opt.verbose {
+		opt.logger.Printf("ORDER: %s removed while %s is still present\n", name, skipped)
+	}
+}
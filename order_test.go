@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrdered(t *testing.T) {
+	testPath := createPath(t)
+	names := []string{"001.job", "002.job", "003.job", "004.job", "005.job"}
+	for _, name := range names {
+		f, err := os.Create(filepath.Join(testPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	var buf bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.ordered = true
+		opts.logger = log.New(&buf, "", 0)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		var warnings []string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, "ORDER: ") {
+				warnings = append(warnings, line)
+			}
+		}
+		// Only 003 and 005 are removed ahead of a file that sorts before them
+		path := func(name string) string { return filepath.Join(testPath, name) }
+		want := []string{
+			"ORDER: " + path("003.job") + " removed while " + path("002.job") + " is still present",
+			"ORDER: " + path("005.job") + " removed while " + path("004.job") + " is still present",
+		}
+		if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+			t.Errorf("Unexpected result. Wanted: %q, got: %q", want, warnings)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for _, name := range []string{"001.job", "003.job", "002.job", "005.job", "004.job"} {
+			if err := os.Remove(filepath.Join(testPath, name)); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+}
+
+func TestFileQueue(t *testing.T) {
+	var q fileQueue
+	for _, name := range []string{"c", "a", "b", "a"} {
+		q.add(name)
+	}
+	if got := strings.Join(q, ","); got != "a,b,c" {
+		t.Fatalf("Unexpected result. Wanted: %s, got: %s", "a,b,c", got)
+	}
+	if skipped, outOfOrder := q.remove("b"); !outOfOrder || skipped != "a" {
+		t.Errorf("Unexpected result. Wanted: b removed ahead of a, got: %q, %t", skipped, outOfOrder)
+	}
+	if _, outOfOrder := q.remove("z"); outOfOrder {
+		t.Error("Unexpected result. Wanted a file that was never held to be in order")
+	}
+	if _, outOfOrder := q.remove("a"); outOfOrder {
+		t.Error("Unexpected result. Wanted the first file to be in order")
+	}
+}
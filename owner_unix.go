@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// ownerOnlySupported reports whether ownedByCurrentUser can tell who owns a file on this platform
+const ownerOnlySupported = true
+
+// ownedByCurrentUser reports whether a directory entry is owned by the user running watchdrain.
+// It is a countIf for -owner-only, so files owned by others are treated as absent.
+func ownedByCurrentUser(entry fs.DirEntry) bool {
+	info, err := entry.Info()
+	if err != nil {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Uid == uint32(os.Getuid())
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// recordLine is a line of a recording, as JSON. The first line is the header, with the directory and its
+// file count at the start of the watch. Each line after it is a raw watcher event.
+type recordLine struct {
+	At    time.Time `json:"at"`
+	Dir   string    `json:"dir,omitempty"`
+	Files uint32    `json:"files,omitempty"`
+	Op    string    `json:"op,omitempty"`
+	Name  string    `json:"name,omitempty"`
+}
+
+// recorder writes a recording of a watch for -replay. Only drainer writes events to it, and it is ended when
+// the watch returns, since drainer can still be taking an event then.
+type recorder struct {
+	mu     sync.Mutex // mu guards enc, err, and ended
+	enc    *json.Encoder
+	err    error // err is the first write error, after which nothing more is written
+	ended  bool  // ended is set by end, after which nothing more is written
+	logger *log.Logger
+}
+
+// newRecorder returns a recorder writing to w, logging a write failure once to logger
+func newRecorder(w io.Writer, logger *log.Logger) *recorder {
+	return &recorder{enc: json.NewEncoder(w), logger: logger}
+}
+
+// header records the directory being watched and its file count at the start
+func (r *recorder) header(d *dir) {
+	r.write(recordLine{At: time.Now(), Dir: *d.dirName, Files: d.count()})
+}
+
+// event records a raw watcher event
+func (r *recorder) event(fileEvent fsnotify.Event) {
+	r.write(recordLine{At: time.Now(), Op: fileEvent.Op.String(), Name: fileEvent.Name})
+}
+
+// end stops the recording, so the writer can be closed
+func (r *recorder) end() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ended = true
+}
+
+func (r *recorder) write(line recordLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil || r.ended {
+		return
+	}
+	if r.err = r.enc.Encode(line); r.err != nil {
+		r.logger.Printf("WARNING: recording stopped: %s\n", r.err)
+	}
+}
+
+// recordOps maps the operation names in a recording back to operations
+var recordOps = map[string]fsnotify.Op{
+	"CREATE": fsnotify.Create,
+	"WRITE":  fsnotify.Write,
+	"REMOVE": fsnotify.Remove,
+	"RENAME": fsnotify.Rename,
+	"CHMOD":  fsnotify.Chmod,
+}
+
+// parseRecordOp parses an operation as written by fsnotify.Op.String, e.g. CREATE|WRITE
+func parseRecordOp(s string) (fsnotify.Op, error) {
+	var op fsnotify.Op
+	for _, name := range strings.Split(s, "|") {
+		o, ok := recordOps[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown op %q", name)
+		}
+		op |= o
+	}
+	return op, nil
+}
+
+// loadRecording reads a recording and returns a dir set to its starting count, with opt set to replay its events.
+// Recursive and rewatch watches add watches as they go, which a replay cannot do, and re-checking files needs
+// the files counted at the start, which a recording does not hold, so they are not replayed.
+func loadRecording(r io.Reader, opt *options) (*dir, error) {
+	if opt.recursive || opt.rewatch || opt.recounts() || opt.baseline {
+		return nil, errors.New("recordings cannot be replayed with -recursive, -rewatch, -owner-only, " +
+			"-deref-symlinks, -older-than, or -baseline")
+	}
+	scanner := bufio.NewScanner(r)
+	var head recordLine
+	opt.replay = []fsnotify.Event{} // A recording with no events still replays rather than watching live
+	for n := 1; scanner.Scan(); n++ {
+		var line recordLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("failed to read recording line %d: %w", n, err)
+		}
+		if n == 1 {
+			head = line
+			continue
+		}
+		op, err := parseRecordOp(line.Op)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recording line %d: %w", n, err)
+		}
+		opt.replay = append(opt.replay, fsnotify.Event{Name: line.Name, Op: op})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+	if head.Dir == "" {
+		return nil, errors.New("failed to read recording: no header")
+	}
+	files := head.Files
+	d := &dir{
+		dirName: &head.Dir,
+		files:   &files,
+		initial: files,
+		subdirs: make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+	if opt.trackComplete {
+		d.complete = make(map[string]bool)
+	}
+	return d, nil
+}
+
+// replayWatcher returns a watcher that delivers the replayed events in opt.replay, as fast as drainer takes
+// them, then closes its Events. It is not a live watcher, and cannot add watches.
+func replayWatcher(draining context.Context, opt *options) *fsnotify.Watcher {
+	events := make(chan fsnotify.Event)
+	go func() {
+		defer close(events)
+		for _, fileEvent := range opt.replay {
+			select {
+			case events <- fileEvent:
+			case <-draining.Done():
+				return
+			}
+		}
+	}()
+	return &fsnotify.Watcher{Events: events, Errors: make(chan error)}
+}
+
+// replayOne replays a recording and returns its summary, as watchOne does for a live watch
+func replayOne(r io.Reader, opts *options) JSONResult {
+	start := time.Now()
+	d, err := loadRecording(r, opts)
+	if err != nil {
+		return summarize("", nil, errResult(err), opts, start)
+	}
+	return summarize(*d.dirName, d, d.watch(opts), opts, start)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	testPath := createPath(t)
+	seeds := []*os.File{createTempFile(t, testPath), createTempFile(t, testPath)}
+	var recording bytes.Buffer
+	var live JSONResult
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.record = newRecorder(&recording, opts.logger)
+		live = watchOne(context.Background(), testPath, opts)
+		if !live.Drained {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %+v", live)
+		}
+
+		// Replaying the recording counts the same events to the same result
+		opts = newTestOptions(t, (1 * time.Minute), 0, false)
+		replayed := replayOne(bytes.NewReader(recording.Bytes()), opts)
+		if replayed.Dir != live.Dir || replayed.Drained != live.Drained || replayed.Reason != live.Reason ||
+			replayed.Remaining != live.Remaining || replayed.TotalCreated != live.TotalCreated ||
+			replayed.TotalRemoved != live.TotalRemoved {
+			t.Errorf("Unexpected result. Wanted: %+v, got: %+v", live, replayed)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		files := append(seeds, createTempFile(t, testPath))
+		time.Sleep(10 * time.Millisecond)
+		for _, f := range files {
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestReplayTimeout(t *testing.T) {
+	testPath := createPath(t)
+	createTempFile(t, testPath)
+	var recording bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (200 * time.Millisecond), 0, false)
+		opts.record = newRecorder(&recording, opts.logger)
+		live := watchOne(context.Background(), testPath, opts)
+		if live.Reason != ErrTimeout.Error() || live.Remaining != 2 {
+			t.Fatalf("Unexpected result. Wanted a timeout with %d remaining, got: %+v", 2, live)
+		}
+
+		// The recording ends with files left, which replays as the timeout it was
+		opts = newTestOptions(t, (1 * time.Minute), 0, false)
+		d, err := loadRecording(bytes.NewReader(recording.Bytes()), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.watchDrain(opts); !errors.Is(err, ErrTimeout) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", ErrTimeout, err)
+		}
+		if got := d.count(); got != live.Remaining {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", live.Remaining, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		createTempFile(t, testPath)
+	})
+}
+
+func TestLoadRecording(t *testing.T) {
+	for _, tc := range []struct {
+		recording string
+		want      string
+	}{
+		{"", "no header"},
+		{`{"dir":"/x","files":1}` + "\n" + `{"op":"DELETE","name":"/x/a"}`, `unknown op "DELETE"`},
+		{`{"dir":"/x"}` + "\n" + `not json`, "line 2"},
+	} {
+		_, err := loadRecording(strings.NewReader(tc.recording), newTestOptions(t, (1*time.Minute), 0, false))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Unexpected result. Wanted an error with %q, got: %v", tc.want, err)
+		}
+	}
+
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	recording := `{"dir":"/x","files":1}` + "\n" + `{"op":"CREATE|WRITE","name":"/x/a"}` + "\n"
+	d, err := loadRecording(strings.NewReader(recording), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *d.dirName != "/x" || d.count() != 1 || len(opts.replay) != 1 || opts.replay[0].Name != "/x/a" {
+		t.Errorf("Unexpected result. Wanted /x with 1 file and 1 event, got: %s %d %v", *d.dirName, d.count(), opts.replay)
+	}
+}
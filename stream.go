@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Kinds of -json-stream update
+const (
+	streamMilestone = "milestone" // another tenth of the starting files drained
+	streamThreshold = "threshold" // net creates reached thresholdWarn of the fileCreates threshold
+	streamProgress  = "progress"  // streamInterval passed since the last progress update
+)
+
+// streamCheck is how often streamMonitor samples the watch for updates
+const streamCheck = 50 * time.Millisecond
+
+// thresholdWarn is the fraction of the fileCreates threshold at which a threshold update is streamed
+const thresholdWarn = 0.8
+
+// streamUpdate is a line of -json-stream output, written when a watch reaches a milestone, nears the file
+// creation threshold, or makes a progress tick. The stream ends with the JSONResult of the watch, with Final set.
+type streamUpdate struct {
+	Dir        string        `json:"dir"`
+	Event      string        `json:"event"`
+	Remaining  uint32        `json:"remaining"`
+	DrainedPct int           `json:"drained_pct,omitempty"` // DrainedPct is the milestone reached, for milestones
+	NetCreates int64         `json:"net_creates,omitempty"` // NetCreates is the net creates toward the threshold, for threshold updates
+	Threshold  uint          `json:"threshold,omitempty"`   // Threshold is the fileCreates threshold, for threshold updates
+	Elapsed    time.Duration `json:"elapsed_ns"`
+}
+
+// streamMonitor writes updates as newline-delimited JSON to opt.stream until draining ends, then closes streamed.
+// Milestones are each tenth of the starting file count drained, in order: if the count drops past several
+// between samples, each is written. Each milestone and the threshold update are written at most once.
+func streamMonitor(d *dir, draining context.Context, opt *options, streamed chan<- struct{}) {
+	defer close(streamed)
+	check := time.NewTicker(streamCheck)
+	defer check.Stop()
+	progress := time.NewTicker(opt.streamInterval)
+	defer progress.Stop()
+
+	enc := json.NewEncoder(opt.stream)
+	start := time.Now()
+	write := func(u streamUpdate) {
+		u.Dir, u.Elapsed = *d.dirName, time.Since(start)
+		_ = enc.Encode(u)
+	}
+	milestone := 0 // milestone is the last milestone written, in tenths
+	warned := false
+	for {
+		select {
+		case <-check.C:
+			files := d.count()
+			if d.initial > 0 && files < d.initial {
+				for reached := int(10 * (d.initial - files) / d.initial); milestone < reached; {
+					milestone++
+					write(streamUpdate{Event: streamMilestone, Remaining: files, DrainedPct: 10 * milestone})
+				}
+			}
+			// The warning follows the threshold: it is held off by the warmup, and counts past its baseline
+			_, _, net := d.netCreates()
+			if opt.fileCreates > 0 && !warned && !d.warmingUp(opt) && float64(net) >= thresholdWarn*float64(opt.fileCreates) {
+				warned = true
+				write(streamUpdate{Event: streamThreshold, Remaining: files, NetCreates: net, Threshold: opt.fileCreates})
+			}
+		case <-progress.C:
+			write(streamUpdate{Event: streamProgress, Remaining: d.count()})
+		case <-draining.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestJSONStream(t *testing.T) {
+	testPath := createPath(t)
+	var files []*os.File
+	for i := 0; i < 10; i++ {
+		files = append(files, createTempFile(t, testPath))
+	}
+	var buf bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 4, false)
+		opts.stream = &buf
+		opts.streamInterval = 200 * time.Millisecond
+		res := watchOne(context.Background(), testPath, opts)
+		res.Final = true
+		if err := printResult(&buf, io.Discard, res, true, false, false, false); err != nil {
+			t.Fatal(err)
+		}
+
+		var milestones []int
+		finals, progress, threshold := 0, 0, 0
+		scanner := bufio.NewScanner(&buf)
+		for n := 1; scanner.Scan(); n++ {
+			var line map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("Unexpected result. Wanted JSON on line %d, got: %q", n, scanner.Text())
+			}
+			if finals > 0 {
+				t.Errorf("Unexpected result. Wanted nothing after the final result, got: %q", scanner.Text())
+			}
+			switch line["event"] {
+			case streamMilestone:
+				milestones = append(milestones, int(line["drained_pct"].(float64)))
+			case streamProgress:
+				progress++
+			case streamThreshold:
+				threshold++
+			default:
+				if line["final"] != true || line["drained"] != true {
+					t.Errorf("Unexpected result. Wanted the final drained result, got: %q", scanner.Text())
+				}
+				finals++
+			}
+		}
+		if finals != 1 {
+			t.Errorf("Did not get expected result. Wanted: %d final result, got: %d", 1, finals)
+		}
+		if threshold != 1 || progress == 0 {
+			t.Errorf("Unexpected result. Wanted 1 threshold update and progress updates, got: %d and %d",
+				threshold, progress)
+		}
+		// Each tenth drained is a milestone, in order, though the watch may end before the last are written
+		if len(milestones) < 5 {
+			t.Errorf("Unexpected result. Wanted at least %d milestones, got: %v", 5, milestones)
+		}
+		for i, pct := range milestones {
+			if pct != 10*(i+1) {
+				t.Errorf("Unexpected result. Wanted milestones in order, got: %v", milestones)
+				break
+			}
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// Creating four files nears the threshold of four net creates without crossing it
+		time.Sleep(100 * time.Millisecond)
+		for i := 0; i < 4; i++ {
+			files = append(files, createTempFile(t, testPath))
+		}
+		time.Sleep(100 * time.Millisecond)
+		for _, f := range files {
+			time.Sleep(30 * time.Millisecond)
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// reasonDrained is the summary reason for a directory that drained
+const reasonDrained = "drained"
+
+// JSONSchemaVersion is the major version of the JSONResult shape.
+// Within a major version, fields are only ever added, never renamed, retyped, or removed.
+const JSONSchemaVersion = 1
+
+// JSONResult describes the outcome of watching one directory, as printed with -json
+type JSONResult struct {
+	SchemaVersion int           `json:"schema_version"`
+	Dir           string        `json:"dir"`
+	Drained       bool          `json:"drained"`
+	Remaining     uint32        `json:"remaining"`
+	Reason        string        `json:"reason"`
+	Error         string        `json:"error,omitempty"`
+	Elapsed       time.Duration `json:"elapsed_ns"`
+	Completed     *int          `json:"completed,omitempty"` // Completed is set when tracking completed files
+	Cycle         int           `json:"cycle,omitempty"`     // Cycle numbers the drains of a -loop run from 1
+	TotalCreated  uint64        `json:"total_created"`       // TotalCreated counts the files created while watching
+	TotalRemoved  uint64        `json:"total_removed"`       // TotalRemoved counts the files removed while watching
+	// InitialFiles lists the files counted at the start, relative to Dir, with -list-initial
+	InitialFiles []string `json:"initial_files,omitempty"`
+	// Final marks the result that ends a -json-stream
+	Final bool `json:"final,omitempty"`
+	// Removable is set with -require-empty-dir for a drained directory, reporting whether it holds no entries at
+	// all, so it could be removed. Removed reports that -remove-dir then removed it.
+	Removable *bool `json:"removable,omitempty"`
+	Removed   bool  `json:"removed,omitempty"`
+	// Change is "up" or "down" for a watch with -until-change that saw the file count change.
+	// Remaining is then the count after the change.
+	Change string `json:"change,omitempty"`
+
+	cause Reason // cause is the Reason of the watch, which Reason names and the exit status follows
+}
+
+// summaryReason names the reason of a result for its summary: the first of the Reason's errors that the result
+// wraps, or "watcher error" for a WatchError and "error" for a Reason with no errors of its own
+func summaryReason(res result) string {
+	switch res.reason {
+	case ReasonDrained:
+		return reasonDrained
+	case ReasonChanged:
+		return "changed"
+	}
+	for _, r := range reasonErrs {
+		if r.reason != res.reason {
+			continue
+		}
+		for _, err := range r.errs {
+			if errors.Is(res.err, err) {
+				return err.Error()
+			}
+		}
+	}
+	if res.reason == ReasonWatcherError {
+		return "watcher error"
+	}
+	return "error"
+}
+
+// expandGlobs expands glob patterns into the directories they match, in order and without duplicates.
+// Matches that are not directories are skipped with a warning, and a pattern that matches no directory is an error.
+func expandGlobs(patterns []string, logger *log.Logger) ([]string, error) {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad glob %q: %w", pattern, err)
+		}
+		found := false
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || !info.IsDir() {
+				logger.Printf("WARNING: skipping %s, which is not a directory\n", match)
+				continue
+			}
+			found = true
+			if !seen[match] {
+				seen[match] = true
+				dirs = append(dirs, match)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no directories match %q", pattern)
+		}
+	}
+	return dirs, nil
+}
+
+// WatchDrainAll watches each directory, each with its own options from newOpts, and returns their summaries in
+// the order of dirs. At most workers directories are watched at once, to cap the watches held; 0 watches them all
+// at once. Canceling ctx stops every watch in progress and returns promptly with ctx's error. The summaries are then
+// partial: watches stopped early report ErrCanceled with their remaining counts, as do directories never started.
+func WatchDrainAll(ctx context.Context, dirs []string, newOpts func() *options, workers int) ([]JSONResult, error) {
+	if workers <= 0 || workers > len(dirs) {
+		workers = len(dirs)
+	}
+	summaries := make([]JSONResult, len(dirs))
+	started := make([]bool, len(dirs))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				summaries[i] = watchOne(ctx, dirs[i], newOpts())
+			}
+		}()
+	}
+feed:
+	for i := range dirs {
+		select {
+		case jobs <- i:
+			started[i] = true
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, dirName := range dirs {
+		if !started[i] {
+			summaries[i] = summarize(dirName, nil, errResult(ErrCanceled), newOpts(), time.Now())
+		}
+	}
+	return summaries, ctx.Err()
+}
+
+// watchOne watches a directory drain and summarizes the outcome. Canceling ctx stops the watch with ErrCanceled.
+func watchOne(ctx context.Context, dirName string, opts *options) JSONResult {
+	start := time.Now()
+	d, err := newDir(dirName, opts)
+	res := errResult(err)
+	if err == nil {
+		stop := context.AfterFunc(ctx, d.Stop)
+		res = d.watch(opts)
+		stop()
+	}
+	s := summarize(dirName, d, res, opts, start)
+	checkEmptyDir(&s, opts)
+	return s
+}
+
+// watchOneChange watches a directory until its file count changes and summarizes the outcome, as watchOne does
+// for a drain
+func watchOneChange(ctx context.Context, dirName string, opts *options) JSONResult {
+	start := time.Now()
+	d, err := newDir(dirName, opts)
+	res := errResult(err)
+	if err == nil {
+		stop := context.AfterFunc(ctx, d.Stop)
+		res = d.watchUntilChange(opts)
+		stop()
+	}
+	return summarize(dirName, d, res, opts, start)
+}
+
+// summarize describes the result of a watch started at start. d is nil if the directory could not be read.
+func summarize(dirName string, d *dir, res result, opts *options, start time.Time) JSONResult {
+	s := JSONResult{SchemaVersion: JSONSchemaVersion, Dir: dirName, Drained: res.drained, cause: res.reason}
+	if d != nil {
+		s.Remaining = d.count()
+		s.InitialFiles = d.initialFiles
+		s.TotalCreated, s.TotalRemoved = d.totals()
+		if opts.trackComplete {
+			completed := d.completed()
+			s.Completed = &completed
+		}
+	}
+	if res.reason == ReasonChanged {
+		s.Remaining = res.files
+		s.Change = "up"
+		if res.change == Remove {
+			s.Change = "down"
+		}
+	}
+	s.Reason = summaryReason(res)
+	if err := res.err; errors.Is(err, ErrTimeout) {
+		s.Error = fmt.Sprintf("%s after %s", err, formatDuration(opts.deadline, opts.rawOutput))
+	} else if err != nil {
+		s.Error = err.Error()
+	}
+	s.Elapsed = time.Since(start)
+	return s
+}
+
+// checkEmptyDir adds the -require-empty-dir check to the result of a drained live watch, once the watch is over,
+// and with -remove-dir removes the directory if it is removable
+func checkEmptyDir(res *JSONResult, opts *options) {
+	if !res.Drained || !opts.requireEmptyDir {
+		return
+	}
+	removable := checkRemovable(res.Dir, opts)
+	res.Removable = &removable
+	res.Removed = removable && opts.removeDir && removeDrained(res.Dir, opts)
+}
+
+// checkRemovable reports whether a drained directory holds no entries at all, including the subdirectories and
+// filtered files that were not counted, logging what is left if not
+func checkRemovable(dirName string, opts *options) bool {
+	f, err := os.Open(dirName)
+	if err != nil {
+		opts.logger.Printf("WARNING: cannot check that %s is empty: %s\n", dirName, err)
+		return false
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(1)
+	switch {
+	case errors.Is(err, io.EOF):
+		return true
+	case err != nil:
+		opts.logger.Printf("WARNING: cannot check that %s is empty: %s\n", dirName, err)
+	default:
+		opts.logger.Printf("WARNING: %s drained of files but still holds %s\n", dirName, names[0])
+	}
+	return false
+}
+
+// removeDrained removes an empty drained directory and reports whether it did, logging why not
+func removeDrained(dirName string, opts *options) bool {
+	if err := os.Remove(dirName); err != nil {
+		opts.logger.Printf("WARNING: failed to remove %s: %s\n", dirName, err)
+		return false
+	}
+	return true
+}
+
+// formatDuration formats a duration for people: to the millisecond under a second, the tenth of a second under
+// a minute, the second under an hour, and the minute after that, leaving off zero seconds and minutes, e.g. 2m3s
+// or 1h4m. With raw it is the exact time.Duration string.
+func formatDuration(d time.Duration, raw bool) string {
+	if raw {
+		return d.String()
+	}
+	switch {
+	case d < time.Second:
+		d = d.Round(time.Millisecond)
+	case d < time.Minute:
+		d = d.Round(100 * time.Millisecond)
+	case d < time.Hour:
+		d = d.Round(time.Second)
+	default:
+		d = d.Round(time.Minute)
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// formatCount formats a count for people with thousands separators, e.g. 1,204. With raw it is the bare number.
+func formatCount(n uint64, raw bool) string {
+	s := strconv.FormatUint(n, 10)
+	if raw {
+		return s
+	}
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// formatFiles formats a file count for people with formatCount, e.g. 1,204 files. With raw it is the bare number.
+func formatFiles(n uint32, raw bool) string {
+	switch {
+	case raw:
+		return formatCount(uint64(n), raw)
+	case n == 1:
+		return "1 file"
+	default:
+		return formatCount(uint64(n), raw) + " files"
+	}
+}
+
+// writeSummaries writes summaries as a table, or as a JSON array of JSONResult if asJSON is set.
+// Summaries are sorted by reason so failures group together ahead of drained directories.
+// The table's counts and durations are formatted for people unless raw is set.
+func writeSummaries(w io.Writer, summaries []JSONResult, asJSON, raw bool) error {
+	sorted := append([]JSONResult(nil), summaries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if (a.Reason == reasonDrained) != (b.Reason == reasonDrained) {
+			return b.Reason == reasonDrained
+		}
+		if a.Reason != b.Reason {
+			return a.Reason < b.Reason
+		}
+		return a.Dir < b.Dir
+	})
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sorted)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIR\tDRAINED\tREMAINING\tREASON\tELAPSED")
+	for _, s := range sorted {
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\n", s.Dir, s.Drained, formatCount(uint64(s.Remaining), raw), s.Reason,
+			formatDuration(s.Elapsed.Round(time.Millisecond), raw))
+	}
+	return tw.Flush()
+}
+
+// printResult reports the outcome of watching one directory, whatever ended the watch.
+// It writes a summary line to stdout, or res as JSON if asJSON is set, and also reports a failure to stderr.
+// verbose adds the created and removed totals to the summary line, and quiet suppresses everything
+// but the failure report. The summary line's counts and durations are formatted for people unless raw is set.
+func printResult(stdout, stderr io.Writer, res JSONResult, asJSON, verbose, quiet, raw bool) error {
+	if res.Error != "" {
+		fmt.Fprintf(stderr, "%s: %s\n", res.Dir, res.Error)
+	}
+	switch {
+	case quiet:
+		return nil
+	case asJSON:
+		return json.NewEncoder(stdout).Encode(res)
+	case res.Change != "":
+		_, err := fmt.Fprintf(stdout, "%s changed:%s files:%s\n", res.Dir, res.Change,
+			formatCount(uint64(res.Remaining), raw))
+		return err
+	default:
+		cycle, totals := "", ""
+		if res.Cycle > 0 {
+			cycle = fmt.Sprintf(" cycle:%d", res.Cycle)
+		}
+		if verbose {
+			totals = fmt.Sprintf(" created:%s removed:%s", formatCount(res.TotalCreated, raw),
+				formatCount(res.TotalRemoved, raw))
+		}
+		if res.Removable != nil {
+			totals += fmt.Sprintf(" removable:%t", *res.Removable)
+		}
+		if res.Removed {
+			totals += " dir-removed:true"
+		}
+		_, err := fmt.Fprintf(stdout, "%s%s drained:%t reason:%s remaining:%s elapsed:%s%s\n", res.Dir, cycle,
+			res.Drained, res.Reason, formatFiles(res.Remaining, raw),
+			formatDuration(res.Elapsed.Round(time.Millisecond), raw), totals)
+		return err
+	}
+}
+
+// printSummaries reports the outcomes of a run over multiple directories with writeSummaries,
+// and also reports each failure to stderr. quiet suppresses everything but the failure reports.
+func printSummaries(stdout, stderr io.Writer, summaries []JSONResult, asJSON, quiet, raw bool) error {
+	for _, s := range summaries {
+		if s.Error != "" {
+			fmt.Fprintf(stderr, "%s: %s\n", s.Dir, s.Error)
+		}
+	}
+	if quiet {
+		return nil
+	}
+	return writeSummaries(stdout, summaries, asJSON, raw)
+}
+
+// The exit statuses, one for each kind of outcome, so that callers can tell them apart without the output
+const (
+	exitDrained   = 0 // every directory drained
+	exitTimeout   = 1 // a deadline or -max-runtime passed first
+	exitUsage     = 2 // the flags were invalid
+	exitThreshold = 3 // a -threshold or -max-files limit was crossed
+	exitError     = 4 // any other failure, e.g. a missing directory
+)
+
+// exitStatus returns the exit status for the Reason of a directory that did not drain
+func exitStatus(reason Reason) int {
+	switch reason {
+	case ReasonChanged:
+		return exitDrained
+	case ReasonTimeout, ReasonMaxRuntime:
+		return exitTimeout
+	case ReasonThreshold:
+		return exitThreshold
+	case ReasonInvalidOptions:
+		return exitUsage
+	}
+	return exitError
+}
+
+// exitCode returns the exit status for the summaries of a run. Over multiple directories,
+// the highest status wins: a failure outranks a crossed threshold, which outranks a timeout.
+func exitCode(summaries []JSONResult) int {
+	code := exitDrained
+	for _, s := range summaries {
+		if !s.Drained {
+			code = max(code, exitStatus(s.cause))
+		}
+	}
+	return code
+}
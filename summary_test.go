@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+func TestWatchAll(t *testing.T) {
+	drainPath := createPath(t)
+	createSeedFiles(t, drainPath)
+	stuckPath := createPath(t)
+	createSeedFiles(t, stuckPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		newOpts := func() *options {
+			return newTestOptions(t, (500 * time.Millisecond), 0, false)
+		}
+		summaries, err := WatchDrainAll(context.Background(), []string{drainPath, stuckPath}, newOpts, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := exitCode(summaries); got != 1 {
+			t.Errorf("Unexpected result. Wanted exit code: %d, got: %d", 1, got)
+		}
+
+		var table bytes.Buffer
+		if err := writeSummaries(&table, summaries, false, true); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("Unexpected result. Wanted a header and 2 rows, got:\n%s", table.String())
+		}
+		// The timed out directory sorts ahead of the drained one
+		for i, want := range []string{stuckPath + " false 2 deadline exceeded", drainPath + " true 0 drained"} {
+			if got := strings.Join(strings.Fields(lines[i+1]), " "); !strings.HasPrefix(got, want) {
+				t.Errorf("Unexpected result. Wanted: %q, got: %q", want, got)
+			}
+		}
+
+		var out bytes.Buffer
+		if err := writeSummaries(&out, summaries, true, true); err != nil {
+			t.Fatal(err)
+		}
+		var decoded []JSONResult
+		if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != 2 || decoded[0].Reason != ErrTimeout.Error() || decoded[1].Reason != reasonDrained {
+			t.Errorf("Unexpected result. Got: %+v", decoded)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for _, file := range []string{file1, file2} {
+			if err := os.Remove(filepath.Join(drainPath, file)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestExitCode(t *testing.T) {
+	opts := newTestOptions(t, time.Minute, 0, false)
+	drained := []JSONResult{{Drained: true}, {Drained: true}}
+	if got := exitCode(drained); got != 0 {
+		t.Errorf("Unexpected result. Wanted exit code: %d, got: %d", 0, got)
+	}
+
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{ErrTimeout, 1},
+		{ErrMaxRuntime, 1},
+		{ErrTooManyCreateEvents, 3},
+		{ErrTooManyFiles, 3},
+		{ErrDirRemoved, 4},
+		{fmt.Errorf("%w: %w", ErrInvalidOptions, ErrNoDeadline), 2},
+		{errors.New("no such file or directory"), 4},
+	}
+	for _, tt := range tests {
+		failed := []JSONResult{{Drained: true}, summarize("/spool", nil, errResult(tt.err), opts, time.Now())}
+		if got := exitCode(failed); got != tt.want {
+			t.Errorf("Unexpected result for %s. Wanted exit code: %d, got: %d", tt.err, tt.want, got)
+		}
+	}
+	// The highest status wins over multiple directories
+	var mixed []JSONResult
+	for _, err := range []error{ErrTimeout, ErrDirRemoved, ErrTooManyFiles} {
+		mixed = append(mixed, summarize("/spool", nil, errResult(err), opts, time.Now()))
+	}
+	if got := exitCode(mixed); got != 4 {
+		t.Errorf("Unexpected result. Wanted exit code: %d, got: %d", 4, got)
+	}
+}
+
+func TestSummaryReason(t *testing.T) {
+	tests := []struct {
+		res  result
+		want string
+	}{
+		{result{drained: true}, "drained"},
+		{result{err: fmt.Errorf("%w: more than 6 files", ErrTooManyFiles)}, ErrTooManyFiles.Error()},
+		{result{err: fmt.Errorf("%w: %w", ErrInvalidOptions, ErrNoDeadline)}, ErrNoDeadline.Error()},
+		{result{err: fmt.Errorf("%w after 2m0s", ErrMaxRuntime)}, ErrMaxRuntime.Error()},
+		{result{err: WatchError{Dir: "/spool", Err: errors.New("queue overflow")}}, "watcher error"},
+		{result{err: errors.New("no such file or directory")}, "error"},
+	}
+	for _, tt := range tests {
+		tt.res.reason = tt.res.classify()
+		if got := summaryReason(tt.res); got != tt.want {
+			t.Errorf("Unexpected result for %v. Wanted: %s, got: %s", tt.res.err, tt.want, got)
+		}
+	}
+}
+
+func TestJSONResult(t *testing.T) {
+	want := JSONResult{
+		SchemaVersion: JSONSchemaVersion,
+		Dir:           "/spool",
+		Drained:       false,
+		Remaining:     7,
+		Reason:        ErrTimeout.Error(),
+		Error:         ErrTimeout.Error(),
+		Elapsed:       1500 * time.Millisecond,
+		TotalCreated:  40,
+		TotalRemoved:  33,
+		InitialFiles:  []string{"temp1.txt", "temp2.txt"},
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"schema_version":1`) {
+		t.Errorf("Missing schema_version in %s", b)
+	}
+	var got JSONResult
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result. Wanted: %+v, got: %+v", want, got)
+	}
+}
+
+func TestPrintResult(t *testing.T) {
+	drainPath := createPath(t)
+	stuckPath := createPath(t)
+	createSeedFiles(t, stuckPath)
+
+	tests := []struct {
+		name       string
+		dir        string
+		wantStdout string
+		wantStderr string
+	}{
+		{"Drained", drainPath, drainPath + " drained:true reason:drained remaining:0 elapsed:", ""},
+		{"Timeout", stuckPath, stuckPath + " drained:false reason:deadline exceeded remaining:2 elapsed:",
+			stuckPath + ": deadline exceeded after 50ms\n"},
+		{"Error", filepath.Join(drainPath, "missing"), filepath.Join(drainPath, "missing") +
+			" drained:false reason:error remaining:0 elapsed:", filepath.Join(drainPath, "missing") + ": failed to open directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOptions(t, (50 * time.Millisecond), 0, false)
+			opts.rawOutput = true
+			res := watchOne(context.Background(), tt.dir, opts)
+			var stdout, stderr bytes.Buffer
+			if err := printResult(&stdout, &stderr, res, false, false, false, true); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(stdout.String(), tt.wantStdout) {
+				t.Errorf("Unexpected stdout. Wanted prefix: %q, got: %q", tt.wantStdout, stdout.String())
+			}
+			if !strings.HasPrefix(stderr.String(), tt.wantStderr) || (tt.wantStderr == "") != (stderr.Len() == 0) {
+				t.Errorf("Unexpected stderr. Wanted prefix: %q, got: %q", tt.wantStderr, stderr.String())
+			}
+
+			stdout.Reset()
+			stderr.Reset()
+			if err := printResult(&stdout, &stderr, res, false, false, true, true); err != nil {
+				t.Fatal(err)
+			}
+			if stdout.Len() != 0 || (tt.wantStderr == "") != (stderr.Len() == 0) {
+				t.Errorf("Unexpected quiet output. Got stdout: %q, stderr: %q", stdout.String(), stderr.String())
+			}
+		})
+	}
+}
+
+func TestWatchOneChange(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		res := watchOneChange(context.Background(), testPath, opts)
+		if res.Change != "down" || res.Remaining != 1 || res.Reason != "changed" || res.Error != "" {
+			t.Errorf("Unexpected result. Wanted a change down to 1 file, got: %+v", res)
+		}
+		if got := exitCode([]JSONResult{res}); got != exitDrained {
+			t.Errorf("Unexpected result. Wanted exit code: %d, got: %d", exitDrained, got)
+		}
+
+		var stdout, stderr bytes.Buffer
+		if err := printResult(&stdout, &stderr, res, false, false, false, true); err != nil {
+			t.Fatal(err)
+		}
+		if want := testPath + " changed:down files:1\n"; stdout.String() != want || stderr.Len() != 0 {
+			t.Errorf("Unexpected stdout. Wanted: %q, got: %q", want, stdout.String())
+		}
+		stdout.Reset()
+		if err := printResult(&stdout, &stderr, res, true, false, false, true); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stdout.String(), `"change":"down"`) {
+			t.Errorf("Missing change in %s", stdout.String())
+		}
+		stdout.Reset()
+		if err := printResult(&stdout, &stderr, res, false, false, true, true); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("Unexpected quiet output. Got stdout: %q", stdout.String())
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(filepath.Join(testPath, file1)); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPrintResultHuman(t *testing.T) {
+	res := JSONResult{Dir: "/spool", Reason: "deadline exceeded", Remaining: 1204, Elapsed: 123456 * time.Millisecond,
+		TotalCreated: 1300, TotalRemoved: 96, Error: "deadline exceeded after 2m0s"}
+	tests := []struct {
+		name       string
+		raw        bool
+		wantStdout string
+	}{
+		{"Human", false, "/spool drained:false reason:deadline exceeded remaining:1,204 files elapsed:2m3s " +
+			"created:1,300 removed:96\n"},
+		{"Raw", true, "/spool drained:false reason:deadline exceeded remaining:1204 elapsed:2m3.456s " +
+			"created:1300 removed:96\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if err := printResult(&stdout, &stderr, res, false, true, false, tt.raw); err != nil {
+				t.Fatal(err)
+			}
+			if stdout.String() != tt.wantStdout {
+				t.Errorf("Unexpected stdout. Wanted: %q, got: %q", tt.wantStdout, stdout.String())
+			}
+		})
+	}
+
+	// The deadline in a timeout error is formatted too
+	for raw, want := range map[bool]string{false: "deadline exceeded after 5m", true: "deadline exceeded after 5m0s"} {
+		opts := newTestOptions(t, (5 * time.Minute), 0, false)
+		opts.rawOutput = raw
+		if got := summarize("/spool", nil, errResult(ErrTimeout), opts, time.Now()).Error; got != want {
+			t.Errorf("Unexpected result. Wanted: %q, got: %q", want, got)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+		raw  string
+	}{
+		{50 * time.Millisecond, "50ms", "50ms"},
+		{1234567 * time.Microsecond, "1.2s", "1.234567s"},
+		{123456 * time.Millisecond, "2m3s", "2m3.456s"},
+		{2 * time.Minute, "2m", "2m0s"},
+		{130 * time.Second, "2m10s", "2m10s"},
+		{time.Hour + 4*time.Minute + 10*time.Second, "1h4m", "1h4m10s"},
+		{time.Hour, "1h", "1h0m0s"},
+		{0, "0s", "0s"},
+	}
+	for _, tt := range tests {
+		if got := formatDuration(tt.d, false); got != tt.want {
+			t.Errorf("Unexpected result. Wanted: %s, got: %s", tt.want, got)
+		}
+		if got := formatDuration(tt.d, true); got != tt.raw {
+			t.Errorf("Unexpected raw result. Wanted: %s, got: %s", tt.raw, got)
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0"}, {999, "999"}, {1000, "1,000"}, {1204, "1,204"}, {1234567, "1,234,567"},
+	}
+	for _, tt := range tests {
+		if got := formatCount(tt.n, false); got != tt.want {
+			t.Errorf("Unexpected result. Wanted: %s, got: %s", tt.want, got)
+		}
+		if got, want := formatCount(tt.n, true), strings.ReplaceAll(tt.want, ",", ""); got != want {
+			t.Errorf("Unexpected raw result. Wanted: %s, got: %s", want, got)
+		}
+	}
+	if got := formatFiles(1, false); got != "1 file" {
+		t.Errorf("Unexpected result. Wanted: %s, got: %s", "1 file", got)
+	}
+}
+
+func TestResultTotals(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		// The totals are kept without a file creation monitor
+		res := watchOne(context.Background(), testPath, newTestOptions(t, (1*time.Minute), 0, false))
+		if !res.Drained || res.TotalCreated != 2 || res.TotalRemoved != 3 {
+			t.Errorf("Unexpected result. Wanted drained with 2 created and 3 removed, got: %+v", res)
+		}
+		var stdout, stderr bytes.Buffer
+		if err := printResult(&stdout, &stderr, res, false, true, false, true); err != nil {
+			t.Fatal(err)
+		}
+		if want := " created:2 removed:3\n"; !strings.HasSuffix(stdout.String(), want) {
+			t.Errorf("Unexpected stdout. Wanted suffix: %q, got: %q", want, stdout.String())
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		files := []*os.File{createTempFile(t, testPath), createTempFile(t, testPath), seed}
+		time.Sleep(10 * time.Millisecond)
+		for _, f := range files {
+			time.Sleep(time.Millisecond)
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestExpandGlobs(t *testing.T) {
+	base := t.TempDir()
+	for _, name := range []string{"batch-1", "batch-2", "other-3"} {
+		if err := os.Mkdir(filepath.Join(base, name), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, "batch-list"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	pattern := filepath.Join(base, "batch-*")
+	got, err := expandGlobs([]string{pattern, filepath.Join(base, "batch-1")}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(base, "batch-1"), filepath.Join(base, "batch-2")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result. Wanted: %q, got: %q", want, got)
+	}
+	if !strings.Contains(buf.String(), "batch-list") {
+		t.Errorf("Unexpected result. Wanted a warning for the batch-list file, got: %q", buf.String())
+	}
+
+	if _, err := expandGlobs([]string{filepath.Join(base, "none-*")}, logger); err == nil {
+		t.Errorf("Unexpected result. Wanted an error for a pattern with no matches, got: %v", err)
+	}
+}
+
+func TestWatchDrainAllCancel(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	first := createPath(t)
+	createSeedFiles(t, first)
+	second := createPath(t)
+	createSeedFiles(t, second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	newOpts := func() *options {
+		return newTestOptions(t, (1 * time.Minute), 0, false)
+	}
+	// With one worker the second directory is still waiting its turn when the run is canceled
+	start := time.Now()
+	summaries, err := WatchDrainAll(ctx, []string{first, second}, newOpts, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Unexpected result. Wanted a prompt return, got: %s", elapsed)
+	}
+	if len(summaries) != 2 {
+		t.Fatalf("Did not get expected result. Wanted: %d summaries, got: %d", 2, len(summaries))
+	}
+	for i, want := range []JSONResult{{Dir: first, Remaining: 2}, {Dir: second, Remaining: 0}} {
+		got := summaries[i]
+		if got.Dir != want.Dir || got.Drained || got.Reason != ErrCanceled.Error() || got.Remaining != want.Remaining {
+			t.Errorf("Unexpected result. Wanted %s canceled with %d remaining, got: %+v", want.Dir, want.Remaining, got)
+		}
+	}
+}
+
+func TestRequireEmptyDir(t *testing.T) {
+	// createPath leaves an empty subdirectory in the directory
+	leftPath := createPath(t)
+	leftFile := createTempFile(t, leftPath)
+	emptyPath := t.TempDir()
+	emptyFile := createTempFile(t, emptyPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		// The directory drains of files, but an empty subdirectory keeps it from being removable
+		var logs bytes.Buffer
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.requireEmptyDir, opts.removeDir = true, true
+		opts.logger = log.New(&logs, "", 0)
+		res := watchOne(context.Background(), leftPath, opts)
+		if !res.Drained || res.Removable == nil || *res.Removable || res.Removed {
+			t.Errorf("Unexpected result. Wanted drained but not removable, got: %+v", res)
+		}
+		if want := "still holds " + sub; !strings.Contains(logs.String(), want) {
+			t.Errorf("Unexpected result. Wanted a warning containing %q, got: %q", want, logs.String())
+		}
+		// The exit status follows the drain alone
+		if got := exitCode([]JSONResult{res}); got != 0 {
+			t.Errorf("Unexpected result. Wanted exit code: %d, got: %d", 0, got)
+		}
+		b, err := json.Marshal(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), `"drained":true`) || !strings.Contains(string(b), `"removable":false`) {
+			t.Errorf("Unexpected result. Wanted drained and not removable, got: %s", b)
+		}
+
+		// Only a live watch checks and removes the directory, not every summary of one
+		opts = newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.requireEmptyDir, opts.removeDir = true, true
+		if res := summarize(t.TempDir(), nil, result{drained: true, reason: ReasonDrained}, opts, time.Now()); res.Removable != nil || res.Removed {
+			t.Errorf("Unexpected result. Wanted no removable check in the summary, got: %+v", res)
+		}
+
+		// A directory with nothing left is removable, and removed
+		res = watchOne(context.Background(), emptyPath, opts)
+		if !res.Drained || res.Removable == nil || !*res.Removable || !res.Removed {
+			t.Errorf("Unexpected result. Wanted drained, removable, and removed, got: %+v", res)
+		}
+		if _, err := os.Stat(emptyPath); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Unexpected result. Wanted %s removed, got: %v", emptyPath, err)
+		}
+		var stdout bytes.Buffer
+		if err := printResult(&stdout, io.Discard, res, false, false, false, false); err != nil {
+			t.Fatal(err)
+		}
+		if want := " removable:true dir-removed:true\n"; !strings.HasSuffix(stdout.String(), want) {
+			t.Errorf("Unexpected stdout. Wanted suffix: %q, got: %q", want, stdout.String())
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for _, f := range []*os.File{leftFile, emptyFile} {
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
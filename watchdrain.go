@@ -4,8 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,42 +20,525 @@ import (
 
 // dir represents a directory to watch drain of files
 type dir struct {
-	mu      sync.RWMutex // mu guards files
+	// mu guards files, created, removed, createBaseline, warmedUp, movedIn, subdirs, watched, complete, counted, and lastEvent
+	mu      sync.RWMutex
 	dirName *string
 	files   *uint32
+	initial uint32 // initial is the file count at the start
+	created uint64 // created counts files created while watching
+	removed uint64 // removed counts files removed while watching
+	movedIn uint64 // movedIn counts the created files guessed to have been moved in rather than opened, for logging
+	// createBaseline is the net creates that fileCreationMonitor set aside at the end of its warmup
+	createBaseline int64
+	warmedUp       bool // warmedUp is set when fileCreationMonitor's warmup ends
+	// subdirs holds the subdirectories counted in recursive mode, so their events are not counted as files.
+	// Removed subdirectories stay as false, since a watched subdirectory reports its own removal as well as its parent.
+	subdirs map[string]bool
+	// watched holds the paths added to the watcher, the directory and its watched subdirectories, as they come and go
+	watched map[string]bool
+	// complete holds the counted files that are non-empty, when tracking completed files
+	complete map[string]bool
+	// replaced holds files whose Remove was not counted because they were back when re-stat'd after removeConfirm,
+	// so the Create that brought them back is not counted either. Only drainer uses it.
+	replaced map[string]bool
+	// pending holds the Removes waiting out removeConfirm, in the order they arrived. Only drainer uses it.
+	pending []pendingRemove
+	// walked holds the files counted by the walk of a subdirectory created while watching, when there is no
+	// counted set, so that a Create event for one, queued while the walk ran, is not counted again.
+	// Only drainer uses it.
+	walked map[string]bool
+	// initialFiles lists the files counted at the start, relative to dirName, when listing them
+	initialFiles []string
+	// counted holds the counted files when re-checking files on every event, for countIf, derefSymlinks, or
+	// olderThan, so a file is uncounted only if it was counted.
+	// With a baseline it holds the files from the start that are still there.
+	counted map[string]bool
+	// queue holds the counted files in order when checking removal order. Only drainer uses it after newDir.
+	queue fileQueue
+	// lastEvent is when drainer last received an event, for watchMonitor
+	lastEvent time.Time
+	logged    uint64        // logged numbers the event log lines. Only drainer uses it.
+	stop      chan struct{} // stop is closed by Stop
+	stopOnce  sync.Once
 }
 
 // newDir returns a new dir to watch drain
-func newDir(dirName string) (*dir, error) {
-	files, err := readDirFiles(dirName)
+func newDir(dirName string, opt *options) (*dir, error) {
+	if opt.checkWritable {
+		if err := preflightWritable(dirName, opt); err != nil {
+			return nil, err
+		}
+	}
+	counted, visit := newCounted(opt)
+	var initialFiles []string
+	if opt.listInitial {
+		visit = andVisit(visit, func(path string) { initialFiles = append(initialFiles, path) })
+	}
+	var queue fileQueue
+	if opt.ordered {
+		visit = andVisit(visit, func(path string) { queue = append(queue, path) })
+	}
+	files, subdirs, err := listDirFiles(dirName, opt, visit)
 	if err != nil {
 		return nil, err
 	}
 	d := &dir{
 		dirName: &dirName,
 		files:   files,
+		initial: *files,
+		subdirs: make(map[string]bool, len(subdirs)),
+		watched: make(map[string]bool),
+		counted: counted,
+		stop:    make(chan struct{}),
+	}
+	if opt.ordered {
+		sort.Strings(queue)
+		d.queue = queue
+	}
+	if opt.listInitial {
+		d.listInitial(initialFiles, opt)
+	}
+	for _, sub := range subdirs {
+		d.subdirs[sub] = true
+	}
+	if opt.trackComplete {
+		if err := d.seedComplete(opt); err != nil {
+			return nil, err
+		}
 	}
 	return d, nil
 }
 
-// readDirFiles reads a directory and returns a file count, ignoring subdirectories
-func readDirFiles(dirName string) (*uint32, error) {
+// preflightWritable warns if the process cannot remove files from a directory, since a drain that depends on this
+// process, or on others running as the same user, to remove them would only time out. With strictPreflight it
+// returns ErrNotWritable instead.
+func preflightWritable(dirName string, opt *options) error {
+	ok, err := canRemoveFrom(dirName)
+	switch {
+	case ok:
+		return nil
+	case opt.strictPreflight:
+		return fmt.Errorf("%w: %s: %w", ErrNotWritable, dirName, err)
+	default:
+		opt.logger.Printf("WARNING: files cannot be removed from %s: %s\n", dirName, err)
+		return nil
+	}
+}
+
+// listInitial records and logs the files counted at the start, relative to the directory and sorted
+func (d *dir) listInitial(paths []string, opt *options) {
+	d.initialFiles = make([]string, 0, len(paths))
+	for _, path := range paths {
+		if rel, err := filepath.Rel(*d.dirName, path); err == nil {
+			path = rel
+		}
+		d.initialFiles = append(d.initialFiles, path)
+	}
+	sort.Strings(d.initialFiles)
+	for _, name := range d.initialFiles {
+		opt.logger.Printf("INITIAL: %s\n", name)
+	}
+}
+
+// seedComplete records the counted files that are already non-empty
+func (d *dir) seedComplete(opt *options) error {
+	f, err := os.Open(*d.dirName)
+	if err != nil {
+		return fmt.Errorf("failed to get file sizes: %w", err)
+	}
+	defer f.Close()
+	d.complete = make(map[string]bool)
+	err = eachDirEntry(f, func(entry fs.DirEntry) error {
+		if entry.IsDir() || !opt.matches(entry.Name()) {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Size() > 0 {
+			d.complete[filepath.Join(*d.dirName, entry.Name())] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get file sizes: %w", err)
+	}
+	return nil
+}
+
+// trackComplete re-stats the file of any event when tracking completed files.
+// A regular file is complete while it is non-empty: a write makes an empty file complete,
+// and truncating it back to zero bytes, or removing it, makes it no longer complete.
+func (d *dir) trackComplete(fileEvent fsnotify.Event, opt *options) {
+	complete := false
+	if !fileEvent.Op.Has(fsnotify.Remove) {
+		info, err := os.Lstat(fileEvent.Name)
+		complete = err == nil && info.Mode().IsRegular() && info.Size() > 0
+	}
+	d.mu.Lock()
+	was := d.complete[fileEvent.Name]
+	if complete {
+		d.complete[fileEvent.Name] = true
+	} else {
+		delete(d.complete, fileEvent.Name)
+	}
+	n := len(d.complete)
+	d.mu.Unlock()
+	if was != complete && opt.verbose {
+		opt.logger.Printf("COMPLETE: %s complete:%t -> %d complete files\n", fileEvent.Name, complete, n)
+	}
+}
+
+// recount re-checks a file against countIf, derefSymlinks, and olderThan after any event on it. It returns Create if the file started
+// counting, or Remove if it stopped, which includes a counted file that is gone. Only the changes that opt.ops counts are made:
+// without Create, a file never starts counting, and without Remove or Rename, a counted file never stops.
+// A counted file that a write made too new for olderThan is still there, so it leaves the count without counting as
+// removed, and the age rescan counts it again once it is old enough.
+func (d *dir) recount(name string, opt *options) (event, bool) {
+	info, err := os.Lstat(name)
+	var counts, aged bool
+	if err == nil {
+		counts, aged = opt.countsAged(filepath.Dir(name), fs.FileInfoToDirEntry(info))
+	}
+	d.mu.Lock()
+	was := d.counted[name]
+	stops := was && opt.ops&(fsnotify.Remove|fsnotify.Rename) != 0
+	switch {
+	case counts && aged && !was && opt.ops.Has(fsnotify.Create):
+		d.counted[name] = true
+		d.mu.Unlock()
+		return Create, true
+	case stops && counts && !aged:
+		delete(d.counted, name)
+		if *d.files > 0 {
+			*d.files--
+		}
+		files := *d.files
+		d.mu.Unlock()
+		if opt.verbose {
+			opt.logger.Printf("TOUCHED: %s is newer than %s -> %d remaining\n", name, opt.olderThan, files)
+		}
+		return 0, false
+	case stops && !counts:
+		delete(d.counted, name)
+		d.mu.Unlock()
+		return Remove, true
+	}
+	d.mu.Unlock()
+	return 0, false
+}
+
+// baselineEvent reports whether an event counts against the baseline: only the Remove of a file from the start
+// does, which takes it out of the baseline. Other events only add to the created and removed totals, so files
+// that arrive after the start still feed the file creation monitor without holding up the drain.
+func (d *dir) baselineEvent(name string, ev event, opt *options) bool {
+	d.mu.Lock()
+	if ev == Remove && d.counted[name] {
+		delete(d.counted, name)
+		d.mu.Unlock()
+		return true
+	}
+	if ev == Create {
+		d.created++
+	} else {
+		d.removed++
+	}
+	d.mu.Unlock()
+	if opt.fileCreates > 0 {
+		notify(opt.eventCh)
+	}
+	return false
+}
+
+// completed returns the number of complete files when tracking completed files
+func (d *dir) completed() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.complete)
+}
+
+// readDirBatch is the number of directory entries eachDirEntry holds in memory at a time
+const readDirBatch = 1024
+
+// readDirFiles reads a directory and returns a file count, ignoring subdirectories.
+// In recursive mode it counts the files in subdirectories too, and also returns the subdirectories it read.
+// Entries are read in batches of readDirBatch, so memory stays bounded for huge directories,
+// and it stops with ErrTooManyFiles as soon as the count exceeds opt.maxFiles.
+func readDirFiles(dirName string, opt *options) (*uint32, []string, error) {
+	return listDirFiles(dirName, opt, nil)
+}
+
+// newCounted returns the set of counted files to fill when re-checking files on every event or counting a baseline,
+// and the visit func that fills it. Both are nil otherwise.
+func newCounted(opt *options) (map[string]bool, func(string)) {
+	if !opt.recounts() && !opt.baseline {
+		return nil, nil
+	}
+	counted := make(map[string]bool)
+	return counted, func(path string) { counted[path] = true }
+}
+
+// andVisit returns a visit func that calls visit, if set, and then also
+func andVisit(visit, also func(string)) func(string) {
+	if visit == nil {
+		return also
+	}
+	return func(path string) {
+		visit(path)
+		also(path)
+	}
+}
+
+// listDirFiles is readDirFiles, also calling visit, if set, with the path of each counted file
+func listDirFiles(dirName string, opt *options, visit func(string)) (*uint32, []string, error) {
+	if opt.recursive {
+		return walkDirFiles(dirName, opt, visit, nil)
+	}
+	if len(opt.names) > 0 {
+		return statNamedFiles(dirName, opt, visit)
+	}
 	d, err := os.Open(dirName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open directory: %w", err)
+		return nil, nil, fmt.Errorf("failed to open directory: %w", err)
 	}
 	defer d.Close()
-	entries, err := d.ReadDir(-1)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get file count: %w", err)
+	var f uint32
+	err = eachDirEntry(d, func(entry fs.DirEntry) error {
+		if opt.counts(dirName, entry) {
+			f++
+			if visit != nil {
+				visit(filepath.Join(dirName, entry.Name()))
+			}
+		}
+		if opt.exceedsMaxFiles(f) {
+			return fmt.Errorf("%w: more than %d files", ErrTooManyFiles, opt.maxFiles)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrTooManyFiles) {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to get file count: %w", err)
+	}
+	return &f, nil, nil
+}
+
+// eachDirEntry calls each with the entries of an open directory, read readDirBatch at a time so memory stays
+// bounded for huge directories, and stops at the first error, from the read or from each
+func eachDirEntry(d *os.File, each func(fs.DirEntry) error) error {
+	for {
+		entries, err := d.ReadDir(readDirBatch)
+		for _, entry := range entries {
+			if err := each(entry); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// statNamedFiles counts the named files present in a directory without reading the whole directory.
+// Named files that do not exist are already drained.
+func statNamedFiles(dirName string, opt *options, visit func(string)) (*uint32, []string, error) {
+	if _, err := os.Stat(dirName); err != nil {
+		return nil, nil, fmt.Errorf("failed to open directory: %w", err)
 	}
 	var f uint32
-	for _, entry := range entries {
-		if !entry.IsDir() {
+	for name := range opt.names {
+		info, err := os.Lstat(filepath.Join(dirName, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to get file count: %w", err)
+		}
+		if opt.counts(dirName, fs.FileInfoToDirEntry(info)) {
 			f++
+			if visit != nil {
+				visit(filepath.Join(dirName, name))
+			}
+		}
+	}
+	return &f, nil, nil
+}
+
+// walkDirFiles counts the files in a directory tree and returns the subdirectories below root.
+// Subdirectories that cannot be read, or that are removed during the walk, are logged under -v and skipped.
+// Only failing to read root is an error. enter, if set, is called with each subdirectory before it is read.
+// Like readDirFiles, it reads each directory in batches with eachDirEntry, and stops as soon as the count
+// exceeds opt.maxFiles, wherever in the tree that is.
+func walkDirFiles(root string, opt *options, visit func(string), enter func(string) error) (*uint32, []string, error) {
+	var f uint32
+	var subdirs []string
+	var walk func(dirName string) error
+	walk = func(dirName string) error {
+		d, err := os.Open(dirName)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		return eachDirEntry(d, func(entry fs.DirEntry) error {
+			path := filepath.Join(dirName, entry.Name())
+			switch {
+			case opt.pruned(path):
+				if opt.verbose {
+					opt.logger.Printf("PRUNE: %s\n", path)
+				}
+			case entry.IsDir():
+				if enter != nil {
+					if err := enter(path); err != nil {
+						return err
+					}
+				}
+				subdirs = append(subdirs, path)
+				if err := walk(path); err != nil && skippable(err) {
+					if opt.verbose {
+						opt.logger.Printf("SKIP: %s\n", err)
+					}
+				} else if err != nil {
+					return err
+				}
+			case opt.counts(dirName, entry):
+				f++
+				if visit != nil {
+					visit(path)
+				}
+				if opt.exceedsMaxFiles(f) {
+					return fmt.Errorf("%w: more than %d files", ErrTooManyFiles, opt.maxFiles)
+				}
+			}
+			return nil
+		})
+	}
+	err := walk(root)
+	if errors.Is(err, ErrTooManyFiles) {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to get file count: %w", err)
+	}
+	return &f, subdirs, nil
+}
+
+// skippable reports whether an error reading a subdirectory in recursive mode should skip it rather than fail
+func skippable(err error) bool {
+	return errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrNotExist)
+}
+
+// trackSubdir reports whether an event in recursive mode is for a subdirectory rather than a file,
+// recording created subdirectories and forgetting removed ones
+func (d *dir) trackSubdir(fileEvent fsnotify.Event, ev event) bool {
+	if ev == Remove {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, ok := d.subdirs[fileEvent.Name]; ok {
+			// The watch on a removed directory goes with it
+			d.subdirs[fileEvent.Name] = false
+			delete(d.watched, fileEvent.Name)
+			return true
 		}
+		return false
 	}
-	return &f, nil
+	info, err := os.Lstat(fileEvent.Name)
+	isDir := err == nil && info.IsDir()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if isDir {
+		d.subdirs[fileEvent.Name] = true
+	} else {
+		delete(d.subdirs, fileEvent.Name)
+	}
+	return isDir
+}
+
+// watchSubdirs adds watches for subdirectories in recursive mode, skipping ones that cannot be watched
+func (d *dir) watchSubdirs(watcher *fsnotify.Watcher, subdirs []string, opt *options) error {
+	for _, sub := range subdirs {
+		err := addWatch(watcher, sub, opt.setupTimeout)
+		if err != nil && skippable(err) {
+			if opt.verbose {
+				opt.logger.Printf("SKIP: %s\n", err)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		d.setWatched(sub)
+	}
+	return nil
+}
+
+// setWatched records a path added to the watcher
+func (d *dir) setWatched(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watched[name] = true
+}
+
+// isWatched reports whether a path is in the watcher
+func (d *dir) isWatched(name string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.watched[name]
+}
+
+// addSubdir watches and counts a subdirectory created while watching in recursive mode, along with its own subdirectories.
+// Each is watched before it is read, so no file created during the walk is missed. A file both walked and reported
+// created is counted once, by the counted set if there is one, and by walked if not.
+// A subdirectory that cannot be read or is removed first is logged under -v and skipped.
+func (d *dir) addSubdir(watcher *fsnotify.Watcher, sub string, opt *options) error {
+	if err := d.watchSubdirs(watcher, []string{sub}, opt); err != nil {
+		return err
+	}
+	counted, visit := newCounted(opt)
+	if counted == nil {
+		counted = make(map[string]bool)
+		visit = func(path string) { counted[path] = true }
+	}
+	enter := func(path string) error { return d.watchSubdirs(watcher, []string{path}, opt) }
+	files, subdirs, err := walkDirFiles(sub, opt, visit, enter)
+	if err != nil && skippable(err) {
+		if opt.verbose {
+			opt.logger.Printf("SKIP: %s\n", err)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	*d.files += *files
+	d.created += uint64(*files)
+	for _, s := range subdirs {
+		d.subdirs[s] = true
+	}
+	for path := range counted {
+		if d.counted != nil {
+			d.counted[path] = true
+			continue
+		}
+		if d.walked == nil {
+			d.walked = make(map[string]bool)
+		}
+		d.walked[path] = true
+	}
+	total := *d.files
+	d.mu.Unlock()
+	return d.checkCount(total, opt)
+}
+
+// walkedEvent reports whether an event is the Create of a file that the walk of a new subdirectory already counted.
+// Either a Create or a Remove of a walked file ends its wait.
+func (d *dir) walkedEvent(name string, ev event) bool {
+	if !d.walked[name] {
+		return false
+	}
+	delete(d.walked, name)
+	return ev == Create
+}
+
+// Stop ends a watch of d in progress, which returns ErrCanceled, and closes its watcher.
+// It is safe to call more than once and from any goroutine.
+func (d *dir) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
 }
 
 func (d *dir) isEmpty() bool {
@@ -59,16 +548,204 @@ func (d *dir) isEmpty() bool {
 	return f == 0
 }
 
+// drained reports whether a watch is done: the directory is empty, or, with a removedGoal,
+// that many files have been removed whatever is left
+func (d *dir) drained(opt *options) bool {
+	if opt.removedGoal > 0 {
+		return d.removals() >= opt.removedGoal
+	}
+	return d.isEmpty()
+}
+
+// subdirList returns the subdirectories counted in recursive mode
+func (d *dir) subdirList() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	subdirs := make([]string, 0, len(d.subdirs))
+	for sub, live := range d.subdirs {
+		if live {
+			subdirs = append(subdirs, sub)
+		}
+	}
+	return subdirs
+}
+
+// count returns the current file count
+func (d *dir) count() uint32 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return *d.files
+}
+
+// setCount replaces the file count, as after re-reading the directory
+func (d *dir) setCount(f uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f < *d.files {
+		d.removed += uint64(*d.files - f)
+	} else {
+		d.created += uint64(f - *d.files)
+	}
+	*d.files = f
+}
+
+// sawEvent records that drainer received an event
+func (d *dir) sawEvent() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastEvent = time.Now()
+}
+
+// sinceEvent returns how long it has been since drainer received an event, or since start if there has been none
+func (d *dir) sinceEvent(start time.Time) time.Duration {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.lastEvent.After(start) {
+		return time.Since(d.lastEvent)
+	}
+	return time.Since(start)
+}
+
+// removals returns the number of files removed while watching
+func (d *dir) removals() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.removed
+}
+
+// totals returns the number of files created and removed while watching
+func (d *dir) totals() (created, removed uint64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.created, d.removed
+}
+
+// netCreates returns the created and removed totals along with the net creates that count toward the fileCreates
+// threshold: creates less removes, less any baseline set at the end of a threshold warmup
+func (d *dir) netCreates() (created, removed uint64, net int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.created, d.removed, int64(d.created) - int64(d.removed) - d.createBaseline
+}
+
+// setCreateBaseline sets aside the net creates so far, if any, so only those past them count toward the
+// fileCreates threshold, and returns them
+func (d *dir) setCreateBaseline() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.createBaseline = max(int64(d.created)-int64(d.removed), 0)
+	d.warmedUp = true
+	return d.createBaseline
+}
+
+// warmingUp reports whether the fileCreates threshold is still held off by thresholdWarmup
+func (d *dir) warmingUp(opt *options) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return opt.thresholdWarmup > 0 && !d.warmedUp
+}
+
 var (
 	// ErrTooManyCreateEvents is returned when file creation events exceed removal events by a set threshold
 	ErrTooManyCreateEvents = errors.New("file creation threshold exceeded")
 	ErrTimeout             = errors.New("deadline exceeded")
+	// ErrTooManyFiles is returned when a directory holds more files than the set maximum
+	ErrTooManyFiles = errors.New("too many files")
+	// ErrMaxRuntime is returned when a watch runs past maxRuntime, however it is progressing
+	ErrMaxRuntime = errors.New("maximum runtime exceeded")
+	// ErrNoDeadline is returned when the deadline is not positive and watching forever was not requested
+	ErrNoDeadline = errors.New("deadline must be greater than zero unless watching with no deadline")
+	// ErrSetupTimeout is returned when adding the directory to the watcher takes longer than the setup timeout
+	ErrSetupTimeout = errors.New("watch setup timed out")
+	// ErrDirRemoved is returned when the watched directory itself is removed or renamed
+	ErrDirRemoved = errors.New("directory removed")
+	// ErrTooSlow is returned when files are removed more slowly than the set minimum rate
+	ErrTooSlow = errors.New("drain rate below minimum")
+	// ErrWatchLost is returned when the watcher has silently stopped watching a directory that still holds files
+	ErrWatchLost = errors.New("watch lost")
+	// ErrDirUnreadable is returned when re-reading the directory mid-watch fails because permission is denied
+	ErrDirUnreadable = errors.New("directory unreadable")
+	// ErrCanceled is returned when a watch is ended with Stop
+	ErrCanceled = errors.New("watch canceled")
+	// ErrNoFiles is returned when files are required but the directory starts empty and none arrive in time
+	ErrNoFiles = errors.New("no files")
+	// ErrNotWritable is returned with strictPreflight when the process cannot remove files from the directory
+	ErrNotWritable = errors.New("directory not writable")
+	// ErrInvalidOptions is returned for options that are out of range or contradict each other
+	ErrInvalidOptions = errors.New("invalid options")
+)
+
+// WatchError is returned when the fsnotify watcher reports an error while watching Dir
+type WatchError struct {
+	Dir string
+	Err error
+}
+
+func (e WatchError) Error() string {
+	return "watcher error: " + e.Err.Error()
+}
+
+func (e WatchError) Unwrap() error {
+	return e.Err
+}
+
+// Reason explains why a watch stopped, so callers can switch on it rather than test for each error.
+// The errors are still returned alongside it.
+type Reason uint8
+
+// Reasons a watch stopped
+const (
+	ReasonError          Reason = iota // ReasonError is any error without a Reason of its own
+	ReasonDrained                      // the directory drained
+	ReasonChanged                      // the file count changed, for watchChange
+	ReasonTimeout                      // ErrTimeout
+	ReasonThreshold                    // ErrTooManyCreateEvents or ErrTooManyFiles
+	ReasonDirRemoved                   // ErrDirRemoved
+	ReasonWatcherError                 // a WatchError or ErrWatchLost
+	ReasonCanceled                     // ErrCanceled or context.Canceled
+	ReasonMaxRuntime                   // ErrMaxRuntime
+	ReasonTooSlow                      // ErrTooSlow
+	ReasonSetupTimeout                 // ErrSetupTimeout
+	ReasonNoFiles                      // ErrNoFiles
+	ReasonDirUnreadable                // ErrDirUnreadable
+	ReasonNotWritable                  // ErrNotWritable
+	ReasonInvalidOptions               // ErrInvalidOptions
 )
 
+// reasonErrs are the errors behind each Reason, in the order classify tests them.
+// The first of them that an error wraps names its summary reason.
+var reasonErrs = []struct {
+	reason Reason
+	errs   []error
+}{
+	{ReasonTimeout, []error{ErrTimeout}},
+	{ReasonMaxRuntime, []error{ErrMaxRuntime}},
+	{ReasonThreshold, []error{ErrTooManyCreateEvents, ErrTooManyFiles}},
+	{ReasonTooSlow, []error{ErrTooSlow}},
+	{ReasonSetupTimeout, []error{ErrSetupTimeout}},
+	{ReasonInvalidOptions, []error{ErrNoDeadline, ErrInvalidOptions}},
+	{ReasonDirRemoved, []error{ErrDirRemoved}},
+	{ReasonWatcherError, []error{ErrWatchLost}},
+	{ReasonCanceled, []error{ErrCanceled, context.Canceled}},
+	{ReasonDirUnreadable, []error{ErrDirUnreadable}},
+	{ReasonNoFiles, []error{ErrNoFiles}},
+	{ReasonNotWritable, []error{ErrNotWritable}},
+}
+
 // event describes a set of file operation notifications
 type event uint8
 
-// Events that trigger a notification to eventCh
+// createKind is a best-effort guess at how a created file arrived, where the platform allows one
+type createKind uint8
+
+// Kinds of file creation
+const (
+	createUnknown createKind = iota
+	createOpened
+	createMovedIn
+)
+
+// Events counted by drainer
 const (
 	Create event = iota
 	Remove
@@ -76,151 +753,1651 @@ const (
 
 // options for watchDrain
 type options struct {
-	eventCh     chan event
-	deadline    time.Duration
+	eventCh    chan struct{} // eventCh notifies fileCreationMonitor that the created and removed totals changed
+	deadline   time.Duration
+	noDeadline bool // noDeadline watches without a deadline, ignoring deadline
+	// maxRuntime stops the watch with ErrMaxRuntime once it has run this long, even while it is draining and
+	// whatever the deadline, noDeadline, and extendOnProgress. 0 means no cap.
+	maxRuntime  time.Duration
 	fileCreates uint
+	// removedGoal, if set, reports the watch drained once this many files have been removed, counting remove
+	// events, whatever the file count. The deadline still applies.
+	removedGoal uint64
+	// thresholdPct stops the watch with ErrTooManyCreateEvents when the file count grows this many percent
+	// past its starting count. It applies alongside fileCreates, and whichever threshold is crossed first stops the watch.
+	// It does not apply to a directory that starts empty.
+	thresholdPct float64
+	// thresholdWarmup holds off the fileCreates threshold for this long from the start, so a burst of creates ahead
+	// of the first removes does not stop the watch. 0 means no warmup.
+	thresholdWarmup time.Duration
+	// ops holds the operations that change the count: Create, Remove, and Rename. newOptions counts Create and
+	// Remove. For countIf, derefSymlinks, and olderThan, files are re-checked on these and on Write and Chmod events,
+	// but a re-check only starts counting a file if ops has Create, and only stops if it has Remove or Rename.
+	ops         fsnotify.Op
 	verbose     bool
+	debug       bool // debug logs every raw watcher event, including the ones that are not counted
+	verboseStat bool // verboseStat adds file metadata to verbose event logs
+	color       bool // color highlights verbose event logs for terminals
+	// status, if set, has a live status line redrawn on it while watching. statusLine only sets it for terminals.
+	status io.Writer
+	// stream, if set, has milestone, threshold, and progress updates written to it as JSON lines while watching.
+	// Progress updates are written every streamInterval.
+	stream         io.Writer
+	streamInterval time.Duration
+	maxFiles       uint // maxFiles caps the file count; 0 means no cap
+	// exts limits counted files to these extensions, each with a leading dot; empty counts every file
+	exts             []string
+	names            map[string]bool // names limits counted files to these base names; empty counts every file
+	extCaseSensitive bool
+	poll             time.Duration // poll re-reads the directory at this interval instead of watching events
+	// mtimeStable reports the directory settled, as drained, once its own modification time has not advanced for
+	// this long, whatever its file count. It stats the directory every poll, or every tenth of mtimeStable, but no
+	// more than once a millisecond, if poll is not set, instead of watching events. 0 means watch for a drain.
+	mtimeStable time.Duration
+	confirm     uint          // confirm is the number of consecutive empty polls needed to report drained
+	minRate     float64       // minRate is the slowest allowed removal rate in files per second; 0 means no minimum
+	rateWindow  time.Duration // rateWindow is the window minRate is measured over
+	// rateWarmup is how long after the start removals go unmeasured before the first rateWindow starts; 0 means
+	// the first window starts at once
+	rateWarmup   time.Duration
+	setupTimeout time.Duration // setupTimeout bounds adding the directory to the watcher; 0 means no bound
+	// watchCheck is how long the watcher can go without events before watchMonitor checks that the watch is
+	// still in place; 0 means no check
+	watchCheck time.Duration
+	// removeConfirm holds each Remove back this long and then re-stats the file, only counting the Remove if the file
+	// is still gone. It keeps atomic saves, which remove and recreate a file, from changing the count. Events go on
+	// being read meanwhile, so a drain's count lags its removes by this long, and no more.
+	removeConfirm time.Duration
+	// extendOnProgress extends the deadline by extendBy each time the file count drops by extendFraction,
+	// never past maxDeadline from the start of the watch
+	extendOnProgress bool
+	extendFraction   float64
+	extendBy         time.Duration
+	maxDeadline      time.Duration
+	progressCh       chan struct{} // progressCh notifies progressDeadlineTimer that the file count dropped
+	untilChange      bool          // untilChange stops at the first change to the file count instead of a drain
+	recursive        bool          // recursive counts and watches the files in subdirectories too
+	// countIf, if set, decides whether a directory entry counts as a file, on top of the other filters.
+	// Files are re-checked on every event, so a file can start or stop counting as it changes.
+	countIf func(fs.DirEntry) bool
+	// derefSymlinks counts a symlink by what it points to, so a symlink to a directory is not a file. By default
+	// symlinks count as files whatever they point to. Either way, a dangling symlink counts as a file.
+	derefSymlinks bool
+	// olderThan, if set, only counts files last modified more than this long ago, as of when they are checked.
+	// Files age into the count with no event to mark it, so drainer re-reads the directory every ageRescan.
+	olderThan time.Duration
+	// baseline only waits for the files counted at the start to go. Files that arrive after the start, even
+	// under the same names, feed the created and removed totals but never the file count.
+	baseline bool
+	// prune holds name patterns, in filepath.Match syntax, that recursive mode skips. A matching subdirectory is
+	// neither counted nor watched, along with everything beneath it, and a matching file is not counted.
+	prune []string
+	// ordered checks that files are removed in path order, as from a queue of sequence-numbered files, and logs
+	// a warning with verbose when a file is removed while one that sorts before it is still there
+	ordered       bool
+	trackComplete bool // trackComplete re-stats files on every event to count the non-empty ones
+	listInitial   bool // listInitial logs, and records, the files counted at the start
+	// requireEmptyDir checks, once the directory drains of files, that it holds no entries at all, reporting
+	// whether it is removable. removeDir then removes it.
+	requireEmptyDir bool
+	removeDir       bool
+	// checkWritable checks that the process can remove files from the directory before watching it, warning if
+	// not, or failing with ErrNotWritable if strictPreflight is set
+	checkWritable   bool
+	strictPreflight bool
+	rewatch         bool // rewatch watches a new directory at the same path if the directory is replaced
+	// requireFiles is how long to wait for a file to arrive in a directory that starts empty before stopping
+	// with ErrNoFiles, rather than reporting it drained. 0 means files are not required.
+	requireFiles time.Duration
+	// minDuration holds off reporting a drain until the watch has run this long, even if the directory starts empty
+	// or empties sooner. Files that appear in that time are counted as usual.
+	minDuration time.Duration
+	// rawOutput keeps the durations and counts in summaries exact, for machine parsing, rather than formatted
+	// for people
+	rawOutput bool
+	logger    *log.Logger // logger receives all human-readable output; newOptions sets the standard logger
+	record    *recorder   // record, if set, records the watch and every raw watcher event for -replay
+	hooks     hooks       // hooks are called as the watch starts and finishes
+	// replay holds recorded events that drainer counts in place of a live watcher's, as loadRecording sets
+	replay []fsnotify.Event
 }
 
-// newOptions returns options, including an eventCh channel if a fileCreationMonitor is set
-func newOptions(deadline time.Duration, fileCreates uint, verbose bool) *options {
+// newOptions returns options, including an eventCh channel if a fileCreationMonitor is set.
+// eventCh holds one pending notification so drainer never blocks on it.
+// It returns ErrInvalidOptions for a negative deadline. A deadline of 0 is only valid with noDeadline,
+// which is set afterwards, so validate checks it along with the other options.
+func newOptions(deadline time.Duration, fileCreates uint, verbose bool) (*options, error) {
+	if deadline < 0 {
+		return nil, fmt.Errorf("%w: deadline %s is negative", ErrInvalidOptions, deadline)
+	}
 	opts := &options{
-		deadline:    deadline,
-		fileCreates: fileCreates,
-		verbose:     verbose,
+		deadline:     deadline,
+		fileCreates:  fileCreates,
+		verbose:      verbose,
+		confirm:      1,
+		rateWindow:   30 * time.Second,
+		rateWarmup:   30 * time.Second,
+		setupTimeout: 30 * time.Second,
+		// extendFraction, extendBy, and maxDeadline only apply if extendOnProgress is set
+		extendFraction: 0.1,
+		extendBy:       time.Minute,
+		maxDeadline:    time.Hour,
+		progressCh:     make(chan struct{}, 1),
+		streamInterval: 10 * time.Second,
+		logger:         log.Default(),
+		ops:            fsnotify.Create | fsnotify.Remove,
 	}
 	if fileCreates > 0 {
-		opts.eventCh = make(chan event)
+		opts.eventCh = make(chan struct{}, 1)
 	}
-	return opts
+	return opts, nil
 }
 
-// result provides return values for watchDrain
-type result struct {
-	err     error
-	drained bool
+// validate returns ErrInvalidOptions, naming the problem, for settings that are out of range or that contradict
+// each other, where one would otherwise be silently ignored or misbehave while watching. watch validates opt
+// before it starts, but callers that set options from user input should validate them up front.
+func (opt *options) validate() error {
+	invalid := func(format string, a ...any) error {
+		return fmt.Errorf("%w: "+format, append([]any{ErrInvalidOptions}, a...)...)
+	}
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"deadline", opt.deadline}, {"poll", opt.poll}, {"setup-timeout", opt.setupTimeout},
+		{"watch-check", opt.watchCheck}, {"remove-confirm", opt.removeConfirm}, {"require-files", opt.requireFiles},
+		{"min-duration", opt.minDuration}, {"mtime-stable", opt.mtimeStable}, {"max-runtime", opt.maxRuntime},
+		{"older-than", opt.olderThan}, {"min-rate-warmup", opt.rateWarmup}, {"threshold-warmup", opt.thresholdWarmup},
+	}
+	for _, dur := range durations {
+		if dur.d < 0 {
+			return invalid("%s %s is negative", dur.name, dur.d)
+		}
+	}
+	switch {
+	case opt.deadline == 0 && !opt.noDeadline:
+		return fmt.Errorf("%w: %w", ErrInvalidOptions, ErrNoDeadline)
+	case opt.logger == nil:
+		return invalid("no logger")
+	case opt.fileCreates > 0 && opt.eventCh == nil:
+		return invalid("eventMonitor threshold set without an eventCh; set it with newOptions")
+	case opt.fileCreates > 0 && (opt.poll > 0 || opt.mtimeStable > 0):
+		return invalid("eventMonitor counts events, so it cannot be used with poll or mtime-stable")
+	case opt.thresholdWarmup > 0 && opt.fileCreates == 0:
+		return invalid("threshold-warmup only applies with an eventMonitor threshold")
+	case opt.removedGoal > 0 && (opt.poll > 0 || opt.mtimeStable > 0):
+		return invalid("removed counts remove events, so it cannot be used with poll or mtime-stable")
+	case opt.ops == 0 || opt.ops&^(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0:
+		return invalid("ops must be some of create, remove, and rename")
+	case opt.thresholdPct < 0:
+		return invalid("threshold-pct %g is negative", opt.thresholdPct)
+	case opt.confirm == 0:
+		return invalid("confirm must be at least 1")
+	case opt.minRate < 0:
+		return invalid("min-rate %g is negative", opt.minRate)
+	case opt.minRate > 0 && opt.rateWindow <= 0:
+		return invalid("min-rate needs a min-rate-window greater than zero")
+	case opt.extendOnProgress && (opt.extendFraction <= 0 || opt.extendFraction > 1):
+		return invalid("extend-fraction %g must be greater than 0 and at most 1", opt.extendFraction)
+	case opt.extendOnProgress && opt.extendBy <= 0:
+		return invalid("extend-by must be greater than zero")
+	case opt.extendOnProgress && !opt.noDeadline && opt.maxDeadline < opt.deadline:
+		return invalid("max-deadline %s is before the deadline %s", opt.maxDeadline, opt.deadline)
+	case opt.baseline && (opt.poll > 0 || opt.mtimeStable > 0 || opt.recursive || opt.rewatch || opt.recounts()):
+		return invalid("baseline tracks files by name, so it cannot be used with poll, mtime-stable, recursive, " +
+			"rewatch, owner-only, deref-symlinks, or older-than")
+	case opt.ordered && (opt.poll > 0 || opt.mtimeStable > 0):
+		return invalid("ordered checks remove events, so it cannot be used with poll or mtime-stable")
+	case opt.removeDir && !opt.requireEmptyDir:
+		return invalid("remove-dir only applies with require-empty-dir")
+	case opt.strictPreflight && !opt.checkWritable:
+		return invalid("strict-preflight only applies with check-writable")
+	case len(opt.prune) > 0 && !opt.recursive:
+		return invalid("prune only applies with recursive")
+	case opt.stream != nil && opt.streamInterval <= 0:
+		return invalid("json-stream-interval must be greater than zero")
+	}
+	return nil
 }
 
-// watchDrain watches a directory until it is empty of files or a deadline ends or a file creation threshold is exceeded
-func (d *dir) watchDrain(opt *options) (bool, error) {
-	ctx := context.Background()
-	draining, cancel := context.WithCancel(ctx)
-	resultCh := make(chan result)
-	watcher, err := fsnotify.NewWatcher()
-
-	if err != nil {
-		log.Fatalln(err)
+// checkCount returns ErrTooManyFiles if a file count grew past maxFiles,
+// or ErrTooManyCreateEvents if it grew past the thresholdPct ceiling
+func (d *dir) checkCount(files uint32, opt *options) error {
+	if opt.exceedsMaxFiles(files) {
+		return fmt.Errorf("%w: more than %d files", ErrTooManyFiles, opt.maxFiles)
 	}
-	if err := watcher.Add(*d.dirName); err != nil {
-		log.Fatalln(err)
+	if ceiling, ok := opt.pctCeiling(d.initial); ok && files > ceiling {
+		return fmt.Errorf("%w: more than %d files, %g%% over the starting %d", ErrTooManyCreateEvents, ceiling,
+			opt.thresholdPct, d.initial)
 	}
+	return nil
+}
 
-	defer func() {
-		cancel()
-		close(resultCh)
-		if err := watcher.Close(); err != nil {
-			log.Fatalln(err)
-		}
-	}()
+// pctCeiling returns the highest file count allowed by thresholdPct for a starting count, if thresholdPct is set.
+// A directory that starts empty has no ceiling, since any percentage of nothing would stop the watch at the first
+// create, and a ceiling past math.MaxUint32 is clamped to it.
+func (opt *options) pctCeiling(initial uint32) (uint32, bool) {
+	if opt.thresholdPct <= 0 || initial == 0 {
+		return 0, false
+	}
+	ceiling := math.Ceil(float64(initial) * (1 + opt.thresholdPct/100))
+	if !(ceiling < math.MaxUint32) {
+		return math.MaxUint32, true
+	}
+	return uint32(ceiling), true
+}
 
-	// Start watching the directory drain
-	go drainer(d, watcher, draining, resultCh, opt)
+// exceedsMaxFiles reports whether a file count is over the maxFiles cap
+func (opt *options) exceedsMaxFiles(files uint32) bool {
+	return opt.maxFiles > 0 && uint(files) > opt.maxFiles
+}
 
-	// Start the deadlineTimer and/or fileCreationMonitor
-	if opt.deadline > 0 {
-		go deadlineTimer(ctx, draining, resultCh, opt)
-	}
-	if opt.fileCreates > 0 {
-		go fileCreationMonitor(draining, resultCh, opt)
+// parseExts splits a comma-separated list of extensions, adding a leading dot where it is missing
+func parseExts(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+		if ext != "" {
+			exts = append(exts, "."+ext)
+		}
 	}
+	return exts
+}
 
-	res := <-resultCh
-	if res.err != nil {
-		return false, res.err
+// parseNames splits a comma-separated list of file base names into a set
+func parseNames(list string) map[string]bool {
+	var names map[string]bool
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if names == nil {
+				names = make(map[string]bool)
+			}
+			names[filepath.Base(name)] = true
+		}
 	}
-	return res.drained, nil
+	return names
 }
 
-// drainer runs while the target directory is not empty, tracking file deletion and creation events
-func drainer(d *dir, watcher *fsnotify.Watcher, draining context.Context, resultCh chan<- result, opt *options) {
-	defer func() {
-		if opt.fileCreates > 0 {
-			close(opt.eventCh)
+// parsePrune splits a comma-separated list of -prune patterns, rejecting malformed ones
+func parsePrune(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
 		}
-	}()
-	for !d.isEmpty() {
-		select {
-		case fileEvent, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			if fileEvent.Op&fsnotify.Remove == fsnotify.Remove {
-				if opt.verbose {
-					log.Printf("%s EVENT: %s\n", fileEvent.Op, fileEvent.Name)
-				}
-				d.mu.Lock()
-				*d.files--
-				d.mu.Unlock()
-				if opt.fileCreates > 0 {
-					opt.eventCh <- Remove
-				}
-			}
-			if fileEvent.Op&fsnotify.Create == fsnotify.Create {
-				if opt.verbose {
-					log.Printf("%s EVENT: %s\n", fileEvent.Op, fileEvent.Name)
-				}
-				d.mu.Lock()
-				*d.files++
-				d.mu.Unlock()
-				if opt.fileCreates > 0 {
-					opt.eventCh <- Create
-				}
-			}
-		case err, ok := <-watcher.Errors:
-			if ok {
-				resultCh <- result{err: err}
-				<-draining.Done()
-			}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad prune pattern %q: %w", pattern, err)
 		}
+		patterns = append(patterns, pattern)
 	}
-	resultCh <- result{drained: true}
-	<-draining.Done()
+	return patterns, nil
 }
 
-func deadlineTimer(ctx, draining context.Context, resultCh chan<- result, opt *options) {
-	deadlineCtx, cancel := context.WithTimeout(ctx, opt.deadline)
-	defer cancel()
+// pruned reports whether a path's base name matches one of the prune patterns
+func (opt *options) pruned(path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range opt.prune {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
 
-	select {
-	case <-deadlineCtx.Done():
-		resultCh <- result{err: ErrTimeout}
-		<-draining.Done()
-	case <-draining.Done():
-		return
+// counts reports whether an entry of dirName counts as a file: it is not a directory, it matches,
+// countIf, if set, accepts it, and it is older than olderThan, if set. With derefSymlinks a symlink is judged
+// by what it points to.
+func (opt *options) counts(dirName string, entry fs.DirEntry) bool {
+	counts, aged := opt.countsAged(dirName, entry)
+	return counts && aged
+}
+
+// countsAged splits counts in two: whether the entry counts at any age, and whether it is old enough for olderThan
+func (opt *options) countsAged(dirName string, entry fs.DirEntry) (counts, aged bool) {
+	if opt.derefSymlinks && entry.Type()&fs.ModeSymlink != 0 {
+		entry = derefEntry(filepath.Join(dirName, entry.Name()), entry)
 	}
+	counts = !entry.IsDir() && opt.matches(entry.Name()) && (opt.countIf == nil || opt.countIf(entry))
+	return counts, counts && (opt.olderThan == 0 || opt.old(entry))
 }
 
-// fileCreationMonitor monitors file creation activity.
-// If file creation is too active and the directory is not going to drain, watchdrain will stop.
-func fileCreationMonitor(draining context.Context, resultCh chan<- result, opt *options) {
-	// `creates` and `removes` track draining activity
-	creates, removes := 0, 0
-	for {
-		if fileEvent, ok := <-opt.eventCh; true {
-			if !ok {
-				return
-			}
-			switch {
-			case fileEvent == Remove:
-				removes++
-			case fileEvent == Create:
-				creates++
-			}
-		}
-		if creates-removes > int(opt.fileCreates) { // 1 is the lowest fileCreates
-			resultCh <- result{err: ErrTooManyCreateEvents}
-			<-draining.Done()
-			return
+// old reports whether an entry was last modified more than olderThan ago, as of now
+func (opt *options) old(entry fs.DirEntry) bool {
+	info, err := entry.Info()
+	return err == nil && time.Since(info.ModTime()) > opt.olderThan
+}
+
+// derefEntry returns the entry for the file a symlink points to, under the symlink's name, or the symlink
+// itself if it is dangling, so a dangling symlink counts as a file until it is removed
+func derefEntry(path string, link fs.DirEntry) fs.DirEntry {
+	info, err := os.Stat(path)
+	if err != nil {
+		return link
+	}
+	return fs.FileInfoToDirEntry(info)
+}
+
+// recounts reports whether files are re-checked on every event, since whether they count can change
+// without a Create or Remove
+func (opt *options) recounts() bool {
+	return opt.countIf != nil || opt.derefSymlinks || opt.olderThan > 0
+}
+
+// matches reports whether a file name is one of the named files and has one of the exts extensions
+func (opt *options) matches(name string) bool {
+	if len(opt.names) > 0 && !opt.names[filepath.Base(name)] {
+		return false
+	}
+	if len(opt.exts) == 0 {
+		return true
+	}
+	ext := filepath.Ext(name)
+	for _, e := range opt.exts {
+		if ext == e || (!opt.extCaseSensitive && strings.EqualFold(ext, e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// opEvent maps an fsnotify operation to the single event it counts as.
+// Remove takes precedence over Create: an operation carrying both bits reports the file as gone,
+// so any one notification changes the file count by exactly one or not at all.
+func opEvent(op fsnotify.Op) (event, bool) {
+	switch {
+	case op.Has(fsnotify.Remove):
+		return Remove, true
+	case op.Has(fsnotify.Create):
+		return Create, true
+	default:
+		return 0, false
+	}
+}
+
+// opEvent is opEvent for the operations in opt.ops. A Rename counts as a Remove when it is allowed,
+// since the file is gone from its name, and a rename within the directory also reports a Create for the new name.
+func (opt *options) opEvent(op fsnotify.Op) (event, bool) {
+	op &= opt.ops
+	if ev, ok := opEvent(op); ok {
+		return ev, ok
+	}
+	if op.Has(fsnotify.Rename) {
+		return Remove, true
+	}
+	return 0, false
+}
+
+// parseOps parses a comma-separated list of the operations to count: create, remove, and rename
+func parseOps(list string) (fsnotify.Op, error) {
+	var ops fsnotify.Op
+	for _, name := range strings.Split(list, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "create":
+			ops |= fsnotify.Create
+		case "remove":
+			ops |= fsnotify.Remove
+		case "rename":
+			ops |= fsnotify.Rename
+		case "":
+		default:
+			return 0, fmt.Errorf("unknown op %q: want create, remove, or rename", name)
+		}
+	}
+	if ops == 0 {
+		return 0, errors.New("no ops to count")
+	}
+	return ops, nil
+}
+
+// apply updates the file count for an event and returns the new count.
+// The count never drops below zero: a Remove on an empty count is ignored and reported as clamped.
+func (d *dir) apply(ev event) (files uint32, clamped bool) {
+	if ev == Remove {
+		files, n := d.applyRemoves(1)
+		return files, n > 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	*d.files++
+	d.created++
+	return *d.files, false
+}
+
+// applyRemoves decrements the file count for n Remove events in one update and returns the new count.
+// Removes that would drop the count below zero are ignored and returned as clamped.
+func (d *dir) applyRemoves(n uint32) (files, clamped uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n > *d.files {
+		clamped = n - *d.files
+		n = *d.files
+	}
+	*d.files -= n
+	d.removed += uint64(n)
+	return *d.files, clamped
+}
+
+// burstWindow is the longest gap between Remove events that are counted as one burst
+const burstWindow = time.Millisecond
+
+// burstMax caps how long a burst is collected, so a steady stream of removes still updates the count,
+// and the burst is also cut at readDirBatch events
+const burstMax = 10 * time.Millisecond
+
+// collectBurst returns fileEvent along with the Remove events that follow it within burstWindow of each other,
+// so a flurry of removes such as from rm * is counted in one update. The burst ends after burstMax or
+// readDirBatch events, or once draining is done.
+// A following event that is not a Remove ends the burst and is returned last; closed reports if events closed.
+func collectBurst(draining context.Context, fileEvent fsnotify.Event,
+	events <-chan fsnotify.Event) (burst []fsnotify.Event, closed bool) {
+	burst = []fsnotify.Event{fileEvent}
+	if !fileEvent.Op.Has(fsnotify.Remove) {
+		return burst, false
+	}
+	timer := time.NewTimer(burstWindow)
+	defer timer.Stop()
+	limit := time.NewTimer(burstMax)
+	defer limit.Stop()
+	for len(burst) < readDirBatch {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return burst, true
+			}
+			burst = append(burst, e)
+			if !e.Op.Has(fsnotify.Remove) {
+				return burst, false
+			}
+			timer.Reset(burstWindow)
+		case <-timer.C:
+			return burst, false
+		case <-limit.C:
+			return burst, false
+		case <-draining.Done():
+			return burst, false
+		}
+	}
+	return burst, false
+}
+
+// countEvents logs and counts a burst of events in order, applying each run of removes as one update.
+// In recursive mode it returns the subdirectories created, for the caller to count and watch.
+// It returns ErrTooManyFiles if a create pushes the count over maxFiles.
+func (d *dir) countEvents(burst []fsnotify.Event, opt *options) (created []string, err error) {
+	var removes uint32
+	flush := func() {
+		if removes == 0 {
+			return
+		}
+		if _, clamped := d.applyRemoves(removes); clamped > 0 && opt.verbose {
+			opt.logger.Printf("WARNING: %d REMOVE EVENTS would drop the file count below zero\n", clamped)
+		}
+		if opt.extendOnProgress {
+			notify(opt.progressCh)
+		}
+		removes = 0
+	}
+	defer flush()
+
+	for _, fileEvent := range burst {
+		fileEvent.Name = d.eventPath(fileEvent.Name)
+		if fileEvent.Name == *d.dirName && (fileEvent.Op.Has(fsnotify.Remove) || fileEvent.Op.Has(fsnotify.Rename)) {
+			return nil, fmt.Errorf("%w: %s %s", ErrDirRemoved, fileEvent.Op, fileEvent.Name)
+		}
+		if fileEvent.Name == *d.dirName && fileEvent.Op.Has(fsnotify.Chmod) {
+			warnUnreadable(*d.dirName, opt)
+			continue
+		}
+		if opt.trackComplete && opt.matches(fileEvent.Name) {
+			d.trackComplete(fileEvent, opt)
+		}
+		ev, counted := opt.opEvent(fileEvent.Op)
+		// A Write or Chmod can change whether a file counts, but an operation that opt.ops leaves out is not reconsidered
+		reconsidered := opt.recounts() && fileEvent.Op&(fsnotify.Write|fsnotify.Chmod) != 0
+		if (!counted && !reconsidered) || (opt.recursive && opt.pruned(fileEvent.Name)) {
+			continue
+		}
+		if counted && opt.recursive && d.trackSubdir(fileEvent, ev) {
+			// A subdirectory created inside a new one may already be watched and counted by its walk
+			if ev == Create && !d.isWatched(fileEvent.Name) {
+				created = append(created, fileEvent.Name)
+			}
+			continue
+		}
+		if !opt.matches(fileEvent.Name) {
+			continue
+		}
+		if opt.recounts() {
+			if ev, counted = d.recount(fileEvent.Name, opt); !counted {
+				continue
+			}
+		}
+		if opt.baseline && !d.baselineEvent(fileEvent.Name, ev, opt) {
+			continue
+		}
+		if opt.recursive && d.walkedEvent(fileEvent.Name, ev) {
+			continue
+		}
+		kind := createUnknown
+		// The kind is a guess, so it is only worked out to be logged, never to decide anything
+		if ev == Create && (opt.verbose || opt.verboseStat) {
+			kind = classifyCreate(fileEvent.Name)
+		}
+		if opt.removeConfirm > 0 && d.awaitConfirm(fileEvent, ev, opt) {
+			continue
+		}
+		if opt.ordered {
+			d.checkOrder(fileEvent.Name, ev, opt)
+		}
+		if kind == createMovedIn {
+			d.mu.Lock()
+			d.movedIn++
+			d.mu.Unlock()
+		}
+		var files uint32
+		if ev == Remove {
+			// Removes are applied together, so the count after this one is what it will be once they are
+			removes++
+			if files = d.count(); files > removes {
+				files -= removes
+			} else {
+				files = 0
+			}
+		} else {
+			flush()
+			files, _ = d.apply(ev)
+		}
+		if opt.verbose || opt.verboseStat {
+			d.logEvent(fileEvent, ev, kind, files, opt)
+		}
+		if ev == Create {
+			if err := d.checkCount(files, opt); err != nil {
+				return nil, err
+			}
+		}
+		if opt.fileCreates > 0 {
+			notify(opt.eventCh)
+		}
+	}
+	return created, nil
+}
+
+// eventPath re-roots the path of an event at the watched directory. Overlay and bind-mounted directories can
+// report paths in another layer, or in another form, than the one watched, so the path is taken relative to
+// dirName, or failing that cut to its base name, and joined back onto dirName. Everything kept by path, and
+// every re-stat, then sees the path it expects.
+func (d *dir) eventPath(name string) string {
+	rel, err := filepath.Rel(*d.dirName, name)
+	switch {
+	case err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)):
+		rel = filepath.Base(name)
+	case rel == ".":
+		return *d.dirName
+	}
+	return filepath.Join(*d.dirName, rel)
+}
+
+// warnUnreadable logs a warning if a change to the watched directory's mode has made it unreadable.
+// The watch goes on counting events, which still arrive, but re-reads of the directory would fail.
+func warnUnreadable(dirName string, opt *options) {
+	f, err := os.Open(dirName)
+	if err == nil {
+		f.Close()
+		return
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		opt.logger.Printf("WARNING: %s is unreadable, counting continues from events: %s\n", dirName, err)
+	}
+}
+
+// pendingRemove is a Remove waiting out removeConfirm before it is counted
+type pendingRemove struct {
+	event fsnotify.Event
+	due   time.Time
+}
+
+// awaitConfirm reports whether an event is held back from the count by removeConfirm. A Remove always is: it waits
+// in pending for confirmRemoves. A Create is the other half of a file replacement, and not counted, if it brings
+// back the file of a pending Remove, which is then dropped, or of one that confirmRemoves found replaced.
+func (d *dir) awaitConfirm(fileEvent fsnotify.Event, ev event, opt *options) bool {
+	if ev == Remove {
+		d.pending = append(d.pending, pendingRemove{event: fileEvent, due: time.Now().Add(opt.removeConfirm)})
+		return true
+	}
+	for i, p := range d.pending {
+		if p.event.Name == fileEvent.Name {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			if opt.verbose {
+				opt.logger.Printf("SKIP: %s %s was replaced, not removed\n", p.event.Op, p.event.Name)
+			}
+			return true
+		}
+	}
+	if d.replaced[fileEvent.Name] {
+		delete(d.replaced, fileEvent.Name)
+		return true
+	}
+	return false
+}
+
+// confirmRemoves re-stats the files of the pending Removes that have waited out removeConfirm, counting the Remove
+// of each file still gone. A file that is back was replaced, so its Remove is dropped, along with the Create for it
+// that is still to come.
+func (d *dir) confirmRemoves(opt *options) {
+	now := time.Now()
+	for len(d.pending) > 0 && !d.pending[0].due.After(now) {
+		fileEvent := d.pending[0].event
+		d.pending = d.pending[1:]
+		if _, err := os.Lstat(fileEvent.Name); err == nil {
+			if d.replaced == nil {
+				d.replaced = make(map[string]bool)
+			}
+			d.replaced[fileEvent.Name] = true
+			if opt.verbose {
+				opt.logger.Printf("SKIP: %s %s was replaced, not removed\n", fileEvent.Op, fileEvent.Name)
+			}
+			continue
+		}
+		if opt.ordered {
+			d.checkOrder(fileEvent.Name, Remove, opt)
+		}
+		files, clamped := d.apply(Remove)
+		if clamped && opt.verbose {
+			opt.logger.Printf("WARNING: REMOVE EVENT %s would drop the file count below zero\n", fileEvent.Name)
+		}
+		if opt.verbose || opt.verboseStat {
+			d.logEvent(fileEvent, Remove, createUnknown, files, opt)
+		}
+		if opt.extendOnProgress {
+			notify(opt.progressCh)
+		}
+		if opt.fileCreates > 0 {
+			notify(opt.eventCh)
+		}
+	}
+}
+
+// confirmTicker returns a channel that ticks four times each removeConfirm, for confirmRemoves, or nil without
+// removeConfirm, along with a func that stops it
+func confirmTicker(opt *options) (<-chan time.Time, func()) {
+	if opt.removeConfirm <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(max(opt.removeConfirm/4, time.Millisecond))
+	return ticker.C, ticker.Stop
+}
+
+// rewatchRetry is how often rewatch checks for a replacement directory
+const rewatchRetry = 10 * time.Millisecond
+
+// rewatch replaces the watch on a directory that was removed or renamed with a watch on the directory that
+// takes its place at the same path, re-seeding the file count from it. It waits up to setupTimeout,
+// or a second if that is unset, for the replacement to appear, and gives up with the draining error if
+// draining ends first.
+func (d *dir) rewatch(watcher *fsnotify.Watcher, draining context.Context, opt *options) error {
+	_ = watcher.Remove(*d.dirName) // The old directory's watch may already be gone
+	wait := opt.setupTimeout
+	if wait <= 0 {
+		wait = time.Second
+	}
+	retry := time.NewTicker(rewatchRetry)
+	defer retry.Stop()
+	for start := time.Now(); ; {
+		info, err := os.Stat(*d.dirName)
+		if err == nil && info.IsDir() {
+			break
+		}
+		if time.Since(start) > wait {
+			return fmt.Errorf("%w: no replacement after %s", ErrDirRemoved, wait)
+		}
+		select {
+		case <-retry.C:
+		case <-draining.Done():
+			return draining.Err()
+		}
+	}
+	if err := addWatch(watcher, *d.dirName, opt.setupTimeout); err != nil {
+		return err
+	}
+	counted, visit := newCounted(opt)
+	files, subdirs, err := listDirFiles(*d.dirName, opt, visit)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	*d.files = *files
+	d.counted = counted
+	d.watched = map[string]bool{*d.dirName: true}
+	d.subdirs = make(map[string]bool, len(subdirs))
+	for _, sub := range subdirs {
+		d.subdirs[sub] = true
+	}
+	d.mu.Unlock()
+	if opt.verbose {
+		opt.logger.Printf("REWATCH: %s has %d files\n", *d.dirName, *files)
+	}
+	return d.watchSubdirs(watcher, subdirs, opt)
+}
+
+// changeResult returns the watchChange result for a file count that went from before to after,
+// reporting whether the count changed at all
+func changeResult(before, after uint32) (result, bool) {
+	switch {
+	case after > before:
+		return result{change: Create, files: after}, true
+	case after < before:
+		return result{change: Remove, files: after}, true
+	default:
+		return result{}, false
+	}
+}
+
+// notify signals ch without blocking. A signal already pending covers this one,
+// since the receiver reads the current totals rather than counting signals.
+func notify(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// statDetail describes a file's size, mode, and modification time for verbose logs.
+// It is best-effort: removed files and files that vanish before they are stat'd return no detail.
+// Lstat does not open the file, so FIFOs and devices cannot block it, and only their mode is reported.
+func statDetail(name string, ev event) string {
+	if ev == Remove {
+		return ""
+	}
+	info, err := os.Lstat(name)
+	if err != nil {
+		return ""
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Sprintf(" (%s, %s)", info.Mode(), info.ModTime().Format(time.TimeOnly))
+	}
+	return fmt.Sprintf(" (%d bytes, %s, %s)", info.Size(), info.Mode(), info.ModTime().Format(time.TimeOnly))
+}
+
+// ANSI escape codes for colored event logs
+const (
+	colorGreen = "\x1b[32m"
+	colorRed   = "\x1b[31m"
+	colorReset = "\x1b[0m"
+)
+
+// logEvent logs a counted event, padding the operation so file names line up.
+// Each line is numbered in sequence and ends with the file count after the event, so the log can be checked
+// against the count.
+func (d *dir) logEvent(fileEvent fsnotify.Event, ev event, kind createKind, files uint32, opt *options) {
+	detail := ""
+	if kind == createMovedIn {
+		detail = " (likely moved in)"
+	}
+	if opt.verboseStat {
+		detail += statDetail(fileEvent.Name, ev)
+	}
+	d.logged++
+	opt.logger.Printf("#%04d %s EVENT: %s%s -> %d remaining\n", d.logged, formatOp(fileEvent.Op, ev, opt.color),
+		fileEvent.Name, detail, files)
+}
+
+// formatOp pads an operation name to a fixed width, colored green for creates and red for removes if color is set
+func formatOp(op fsnotify.Op, ev event, color bool) string {
+	name := fmt.Sprintf("%-6s", op)
+	if !color {
+		return name
+	}
+	if ev == Remove {
+		return colorRed + name + colorReset
+	}
+	return colorGreen + name + colorReset
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// statusLine returns f for a live status line if enabled and f is a terminal, or nil for no status line
+func statusLine(f *os.File, enabled bool) io.Writer {
+	if !enabled || !isTerminal(f) {
+		return nil
+	}
+	return f
+}
+
+// spinner holds the frames of the status line spinner
+var spinner = []rune("⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏")
+
+// statusInterval is how often the status line is redrawn
+const statusInterval = 100 * time.Millisecond
+
+// formatStatus returns a status line showing the directory, its file count, and the elapsed time as mm:ss
+func formatStatus(frame rune, dirName string, files uint32, elapsed time.Duration) string {
+	secs := int(elapsed.Seconds())
+	return fmt.Sprintf("%c %s  %d files  %02d:%02d", frame, dirName, files, secs/60, secs%60)
+}
+
+// statusRedrawer redraws the status line on opt.status in place with a carriage return until draining ends,
+// then clears it and closes redrawn
+func statusRedrawer(d *dir, draining context.Context, opt *options, redrawn chan<- struct{}) {
+	defer close(redrawn)
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for frame := 0; ; frame++ {
+		fmt.Fprintf(opt.status, "\r\x1b[K%s", formatStatus(spinner[frame%len(spinner)], *d.dirName, d.count(),
+			time.Since(start)))
+		select {
+		case <-ticker.C:
+		case <-draining.Done():
+			fmt.Fprint(opt.status, "\r\x1b[K")
+			return
+		}
+	}
+}
+
+// useColor reports whether event logs written to f should be colored.
+// Color is off when f is not a terminal, when noColor is set, or when the NO_COLOR environment variable is set.
+func useColor(f *os.File, noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// newWatcher creates the fsnotify watcher for watchDrain
+var newWatcher = fsnotify.NewWatcher
+
+// watcherAdd adds a path to an fsnotify watcher
+var watcherAdd = (*fsnotify.Watcher).Add
+
+// addWatch adds a path to the watcher, giving up with ErrSetupTimeout if that takes longer than timeout.
+// A timeout of 0 waits indefinitely. An Add that times out is abandoned and finishes in the background.
+func addWatch(watcher *fsnotify.Watcher, name string, timeout time.Duration) error {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	add := watcherAdd // An abandoned Add outlives this call, so it must not read the var later
+	go func() {
+		errCh <- add(watcher, name)
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("failed to watch directory %s: %w", name, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: watching %s took longer than %s", ErrSetupTimeout, name, timeout)
+	}
+}
+
+// result provides return values for watchDrain and watchChange
+type result struct {
+	err     error
+	drained bool
+	change  event  // change is Create if the file count went up or Remove if it went down, for watchChange
+	files   uint32 // files is the file count after the change for watchChange, or when the watch ended for a drain
+	reason  Reason // reason is set by watch for every result
+}
+
+// hooks are callbacks for the stages of a watch, for code that embeds watchdrain and wants side effects such as
+// metrics or notifications. Each is optional. onStart is called once the watch has validated its options, with
+// the starting file count, and the outcome hooks are called with the result once the watch has finished.
+type hooks struct {
+	onStart     func(initial uint32)
+	onDrained   func(result)
+	onTimeout   func(result)
+	onThreshold func(result) // onThreshold is called for ErrTooManyCreateEvents and ErrTooManyFiles
+}
+
+// run calls the outcome hook, if any, for a result
+func (h hooks) run(res result) {
+	var hook func(result)
+	switch res.reason {
+	case ReasonDrained:
+		hook = h.onDrained
+	case ReasonTimeout:
+		hook = h.onTimeout
+	case ReasonThreshold:
+		hook = h.onThreshold
+	}
+	if hook != nil {
+		hook(res)
+	}
+}
+
+// classify returns the Reason for a result
+func (res result) classify() Reason {
+	switch {
+	case res.err == nil && res.drained:
+		return ReasonDrained
+	case res.err == nil:
+		return ReasonChanged
+	}
+	for _, r := range reasonErrs {
+		for _, err := range r.errs {
+			if errors.Is(res.err, err) {
+				return r.reason
+			}
+		}
+	}
+	var watchErr WatchError
+	if errors.As(res.err, &watchErr) {
+		return ReasonWatcherError
+	}
+	return ReasonError
+}
+
+// errResult returns the result, with its reason set, for an error that ended a watch or kept one from starting
+func errResult(err error) result {
+	res := result{err: err}
+	res.reason = res.classify()
+	return res
+}
+
+// watchDrain watches a directory until it is empty of files or a deadline ends or a file creation threshold is exceeded
+func (d *dir) watchDrain(opt *options) (bool, error) {
+	res := d.watch(opt)
+	if res.err != nil {
+		return false, res.err
+	}
+	return res.drained, nil
+}
+
+// watchChange watches a directory until its file count changes, returning Create if it went up or Remove if it
+// went down, along with the new count. The deadline still applies.
+func (d *dir) watchChange(opt *options) (event, uint32, error) {
+	res := d.watchUntilChange(opt)
+	return res.change, res.files, res.err
+}
+
+// watchUntilChange runs watch until the file count changes. It sets untilChange on a copy of opt,
+// so the caller's options can still be used for a drain.
+func (d *dir) watchUntilChange(opt *options) result {
+	changeOpt := *opt
+	changeOpt.untilChange = true
+	return d.watch(&changeOpt)
+}
+
+// watch runs the watch set up by opt and returns the first result, with its reason set,
+// calling the hooks in opt along the way
+func (d *dir) watch(opt *options) (res result) {
+	defer func() {
+		if !opt.untilChange {
+			res.files = d.count()
+		}
+		res.reason = res.classify()
+		opt.hooks.run(res)
+	}()
+	if err := opt.validate(); err != nil {
+		return result{err: err}
+	}
+	if opt.hooks.onStart != nil {
+		opt.hooks.onStart(d.count())
+	}
+	if opt.record != nil {
+		opt.record.header(d)
+		defer opt.record.end()
+	}
+	settling := opt.mtimeStable > 0 && !opt.untilChange
+	// An empty directory is already drained, unless polling must confirm it over several reads or files must be removed
+	if d.drained(opt) && !opt.untilChange && !settling && opt.minDuration == 0 && opt.requireFiles == 0 &&
+		(opt.poll == 0 || opt.confirm <= 1) {
+		return result{drained: true}
+	}
+	ctx := context.Background()
+	draining, cancel := context.WithCancel(ctx)
+	resultCh := make(chan result)
+
+	// resultCh is never closed: the first result delivered wins, and canceling draining releases the rest
+	defer cancel()
+
+	// Start polling or watching the directory drain
+	if settling {
+		go mtimeSettler(d, draining, resultCh, opt)
+	} else if opt.poll > 0 {
+		go poller(d, draining, resultCh, opt)
+	} else if opt.replay != nil {
+		go drainer(d, replayWatcher(draining, opt), draining, resultCh, opt)
+	} else {
+		// A watcher that cannot be made, e.g. at the inotify instance limit, fails only this watch
+		watcher, err := newWatcher()
+		if err != nil {
+			return result{err: WatchError{Dir: *d.dirName, Err: err}}
+		}
+		defer func() {
+			if err := watcher.Close(); err != nil {
+				opt.logger.Printf("WARNING: failed to close the watcher for %s: %s\n", *d.dirName, err)
+			}
+		}()
+		if err := addWatch(watcher, *d.dirName, opt.setupTimeout); err != nil {
+			return result{err: err}
+		}
+		d.setWatched(*d.dirName)
+		defer trackWatches(d, opt)()
+		if err := d.watchSubdirs(watcher, d.subdirList(), opt); err != nil {
+			return result{err: err}
+		}
+		go drainer(d, watcher, draining, resultCh, opt)
+		if opt.watchCheck > 0 {
+			go watchMonitor(d, watcher, draining, resultCh, opt)
+		}
+	}
+
+	// Start the deadlineTimer and/or fileCreationMonitor
+	switch {
+	case opt.noDeadline:
+	case opt.extendOnProgress:
+		go progressDeadlineTimer(d, draining, resultCh, opt)
+	default:
+		go newDeadlineTimer(opt.deadline).run(draining, resultCh)
+	}
+	if opt.maxRuntime > 0 {
+		go maxRuntimeTimer(draining, resultCh, opt)
+	}
+	if opt.fileCreates > 0 && opt.poll == 0 && !settling {
+		go fileCreationMonitor(d, draining, resultCh, opt)
+	}
+	if opt.minRate > 0 {
+		go rateMonitor(d, draining, resultCh, opt)
+	}
+	go stopMonitor(d, draining, resultCh)
+	if opt.status != nil {
+		// Wait for the status line to be cleared, so it is gone before the result is printed
+		redrawn := make(chan struct{})
+		go statusRedrawer(d, draining, opt, redrawn)
+		defer func() {
+			cancel()
+			<-redrawn
+		}()
+	}
+	if opt.stream != nil {
+		// Wait for the stream updates to stop, so the final result is written last
+		streamed := make(chan struct{})
+		go streamMonitor(d, draining, opt, streamed)
+		defer func() {
+			cancel()
+			<-streamed
+		}()
+	}
+	if d.awaitingFiles(opt) {
+		go noFilesMonitor(d, draining, resultCh, opt)
+	}
+
+	return <-resultCh
+}
+
+// drainer runs while the target directory is not empty, tracking file deletion and creation events.
+// It returns once draining ends, so it never counts events, or signals eventCh, for a watch that is over,
+// even if the watcher is not closed.
+func drainer(d *dir, watcher *fsnotify.Watcher, draining context.Context, resultCh chan<- result, opt *options) {
+	defer func() {
+		if opt.fileCreates > 0 {
+			close(opt.eventCh)
+		}
+	}()
+	hold, stop := minDurationTimer(opt)
+	defer stop()
+	rescan, stopRescan := ageRescanTicker(opt)
+	defer stopRescan()
+	confirm, stopConfirm := confirmTicker(opt)
+	defer stopConfirm()
+	for opt.untilChange || !d.drained(opt) || hold != nil || d.awaitingFiles(opt) {
+		select {
+		case <-hold:
+			hold = nil
+		case <-confirm:
+			before := d.count()
+			d.confirmRemoves(opt)
+			if res, changed := changeResult(before, d.count()); opt.untilChange && changed {
+				deliver(draining, resultCh, res)
+				return
+			}
+		case <-rescan:
+			before := d.count()
+			if err := d.rescanAged(opt); err != nil {
+				deliver(draining, resultCh, result{err: err})
+				return
+			}
+			if res, changed := changeResult(before, d.count()); opt.untilChange && changed {
+				deliver(draining, resultCh, res)
+				return
+			}
+		case fileEvent, ok := <-watcher.Events:
+			if !ok {
+				replayEnded(d, draining, resultCh, opt)
+				return
+			}
+			d.sawEvent()
+			// A change is reported at the first counted event, so only drains collect bursts
+			burst, closed := []fsnotify.Event{fileEvent}, false
+			if !opt.untilChange {
+				burst, closed = collectBurst(draining, fileEvent, watcher.Events)
+			}
+			for _, e := range burst {
+				if opt.debug {
+					opt.logger.Printf("RAW: %-6s %s\n", e.Op, e.Name)
+				}
+				if opt.record != nil {
+					opt.record.event(e)
+				}
+			}
+			before := d.count()
+			created, err := d.countEvents(burst, opt)
+			for _, sub := range created {
+				if err == nil {
+					err = d.addSubdir(watcher, sub, opt)
+				}
+			}
+			if errors.Is(err, ErrDirRemoved) && opt.rewatch {
+				err = d.rewatch(watcher, draining, opt)
+			}
+			if err != nil {
+				deliver(draining, resultCh, result{err: err})
+				return
+			}
+			if res, changed := changeResult(before, d.count()); opt.untilChange && changed {
+				deliver(draining, resultCh, res)
+				return
+			}
+			if closed {
+				replayEnded(d, draining, resultCh, opt)
+				return
+			}
+		case err, ok := <-watcher.Errors:
+			if ok {
+				deliver(draining, resultCh, result{err: WatchError{Dir: *d.dirName, Err: err}})
+				return
+			}
+		case <-draining.Done():
+			return
+		}
+	}
+	deliver(draining, resultCh, result{drained: true})
+}
+
+// replayEnded ends a replay once its recorded events run out. An empty directory is drained, whatever is left
+// of minDuration, since a replay does not wait. Otherwise it ends with ErrTimeout, since the recorded watch went
+// on without events until something else stopped it.
+// A live watcher only closes its events once the watch is over, so for a live watch it does nothing.
+func replayEnded(d *dir, draining context.Context, resultCh chan<- result, opt *options) {
+	switch {
+	case opt.replay == nil:
+	case d.drained(opt) && !opt.untilChange:
+		deliver(draining, resultCh, result{drained: true})
+	default:
+		err := fmt.Errorf("%w: recording ended with %d files left", ErrTimeout, d.count())
+		deliver(draining, resultCh, result{err: err})
+	}
+}
+
+// stopTimer stops a timer and drains its channel, whether or not it already fired or was stopped
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+// progressDeadlineTimer is a deadlineTimer that extends the deadline while the directory is draining.
+// Each time the file count drops by extendFraction of the count at the last extension, or at the start,
+// the deadline moves extendBy later, capped at maxDeadline after the start.
+func progressDeadlineTimer(d *dir, draining context.Context, resultCh chan<- result, opt *options) {
+	start := time.Now()
+	deadline := start.Add(opt.deadline)
+	ceiling := start.Add(opt.maxDeadline)
+	timer := newDeadlineTimer(opt.deadline)
+	go timer.run(draining, resultCh)
+
+	milestone := d.count()
+	for {
+		select {
+		case <-opt.progressCh:
+			files := d.count()
+			if files >= milestone || float64(milestone-files) < opt.extendFraction*float64(milestone) {
+				continue
+			}
+			milestone = files
+			if deadline = deadline.Add(opt.extendBy); deadline.After(ceiling) {
+				deadline = ceiling
+			}
+			if opt.verbose {
+				opt.logger.Printf("DEADLINE: extended to %s with %d files left\n", deadline.Sub(start).Round(time.Millisecond), files)
+			}
+			timer.Reset(time.Until(deadline))
+		case <-draining.Done():
+			return
+		}
+	}
+}
+
+// minDurationTimer returns a channel that fires once opt.minDuration has passed, and a func to stop it.
+// The channel is nil, and never fires, if there is no minDuration.
+func minDurationTimer(opt *options) (<-chan time.Time, func() bool) {
+	if opt.minDuration <= 0 {
+		return nil, func() bool { return false }
+	}
+	timer := time.NewTimer(opt.minDuration)
+	return timer.C, timer.Stop
+}
+
+// ageRescan returns how often drainer re-reads the directory for files that aged past olderThan: every tenth of
+// olderThan, and at least every minute
+func ageRescan(opt *options) time.Duration {
+	interval := opt.olderThan / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	return interval
+}
+
+// ageRescanTicker returns a channel that ticks every ageRescan when counting files by age, or nil otherwise,
+// along with a func that stops it. A replay has no directory to re-read.
+func ageRescanTicker(opt *options) (<-chan time.Time, func()) {
+	if opt.olderThan <= 0 || opt.replay != nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(ageRescan(opt))
+	return ticker.C, ticker.Stop
+}
+
+// rescanAged re-reads the directory and counts the files that have aged past olderThan since they were last
+// checked. Aging is not a creation, so the created total is unchanged. Files that stop counting are left to their
+// events, since a file only gets newer when it changes. It returns ErrTooManyFiles if the count grows past maxFiles.
+func (d *dir) rescanAged(opt *options) error {
+	var old []string
+	if _, _, err := listDirFiles(*d.dirName, opt, func(path string) { old = append(old, path) }); err != nil {
+		if errors.Is(err, ErrTooManyFiles) {
+			return err
+		}
+		if opt.verbose {
+			opt.logger.Printf("WARNING: rescan for aged files failed: %s\n", err)
+		}
+		return nil
+	}
+	for _, path := range old {
+		d.mu.Lock()
+		if d.counted[path] {
+			d.mu.Unlock()
+			continue
+		}
+		d.counted[path] = true
+		*d.files++
+		files := *d.files
+		d.mu.Unlock()
+		if opt.verbose {
+			opt.logger.Printf("AGED: %s is older than %s -> %d remaining\n", path, opt.olderThan, files)
+		}
+		if err := d.checkCount(files, opt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confirmer tracks consecutive empty observations of a directory
+type confirmer struct {
+	need uint // need is the number of consecutive empty observations that confirm a drain
+	seen uint
+}
+
+// observe records a file count and reports whether the drain is confirmed.
+// A count above zero resets the run of empty observations.
+func (c *confirmer) observe(files uint32) bool {
+	if files > 0 {
+		c.seen = 0
+		return false
+	}
+	c.seen++
+	return c.seen >= c.need
+}
+
+// poller re-reads the directory every poll interval until opt.confirm consecutive reads find it empty.
+// The count from newDir is the first read.
+func poller(d *dir, draining context.Context, resultCh chan<- result, opt *options) {
+	ticker := time.NewTicker(opt.poll)
+	defer ticker.Stop()
+
+	hold, stop := minDurationTimer(opt)
+	defer stop()
+	c := confirmer{need: opt.confirm}
+	start := d.count()
+	// Polls during minDuration are not counted toward confirm
+	for opt.untilChange || hold != nil || d.awaitingFiles(opt) || !c.observe(d.count()) {
+		select {
+		case <-hold:
+			hold = nil
+		case <-ticker.C:
+			files, _, err := readDirFiles(*d.dirName, opt)
+			if errors.Is(err, fs.ErrPermission) {
+				err = fmt.Errorf("%w: %w", ErrDirUnreadable, err)
+			}
+			if err != nil {
+				deliver(draining, resultCh, result{err: err})
+				return
+			}
+			if opt.verbose {
+				opt.logger.Printf("POLL: %s has %d files\n", *d.dirName, *files)
+			}
+			d.setCount(*files)
+			if err := d.checkCount(*files, opt); err != nil {
+				deliver(draining, resultCh, result{err: err})
+				return
+			}
+			if res, changed := changeResult(start, *files); opt.untilChange && changed {
+				deliver(draining, resultCh, res)
+				return
+			}
+			if opt.extendOnProgress {
+				notify(opt.progressCh)
+			}
+		case <-draining.Done():
+			return
+		}
+	}
+	deliver(draining, resultCh, result{drained: true})
+}
+
+// mtimeSettler stats the directory until its modification time has not advanced for mtimeStable,
+// then reports it drained with the file count re-read. Files coming and going only matter through
+// the directory mtime, which the filesystem updates as entries are added, removed, or renamed.
+func mtimeSettler(d *dir, draining context.Context, resultCh chan<- result, opt *options) {
+	interval := opt.poll
+	if interval <= 0 {
+		// A tenth of a tiny window would spin the ticker, or be 0, which it does not take
+		interval = max(opt.mtimeStable/10, time.Millisecond)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var mtime time.Time
+	var since time.Time
+	for {
+		info, err := os.Stat(*d.dirName)
+		if err != nil {
+			deliver(draining, resultCh, result{err: fmt.Errorf("failed to stat directory: %w", err)})
+			return
+		}
+		now := time.Now()
+		if !info.ModTime().Equal(mtime) {
+			if opt.verbose && !since.IsZero() {
+				opt.logger.Printf("MTIME: %s changed at %s\n", *d.dirName, info.ModTime().Format(time.RFC3339Nano))
+			}
+			mtime, since = info.ModTime(), now
+		} else if now.Sub(since) >= opt.mtimeStable {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-draining.Done():
+			return
+		}
+	}
+	files, _, err := readDirFiles(*d.dirName, opt)
+	if err != nil {
+		deliver(draining, resultCh, result{err: err})
+		return
+	}
+	if opt.verbose {
+		opt.logger.Printf("MTIME: %s settled for %s with %d files\n", *d.dirName, opt.mtimeStable, *files)
+	}
+	d.setCount(*files)
+	deliver(draining, resultCh, result{drained: true})
+}
+
+// deadlineTimer is a deadline that can be moved while it runs. run waits out the deadline in its own goroutine,
+// sending ErrTimeout when it passes, and Reset and Stop control it from others.
+type deadlineTimer struct {
+	initial time.Duration
+	reset   chan time.Duration // reset carries a new deadline, from now, to run
+	stop    chan struct{}      // stop tells run to stop the deadline
+	done    chan struct{}      // done is closed when run returns, so controls sent after that do not block
+}
+
+// newDeadlineTimer returns a deadlineTimer for a deadline of d from when it is run
+func newDeadlineTimer(d time.Duration) *deadlineTimer {
+	return &deadlineTimer{initial: d, reset: make(chan time.Duration), stop: make(chan struct{}),
+		done: make(chan struct{})}
+}
+
+// Reset moves the deadline to d from now, restarting it if it was stopped. A d of 0 or less passes it now.
+func (t *deadlineTimer) Reset(d time.Duration) {
+	select {
+	case t.reset <- d:
+	case <-t.done:
+	}
+}
+
+// Stop stops the deadline from passing until it is Reset
+func (t *deadlineTimer) Stop() {
+	select {
+	case t.stop <- struct{}{}:
+	case <-t.done:
+	}
+}
+
+// run sends ErrTimeout on resultCh once the deadline passes, unless draining ends first
+func (t *deadlineTimer) run(draining context.Context, resultCh chan<- result) {
+	defer close(t.done)
+	timer := time.NewTimer(t.initial)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			deliver(draining, resultCh, result{err: ErrTimeout})
+			return
+		case d := <-t.reset:
+			stopTimer(timer)
+			timer.Reset(d)
+		case <-t.stop:
+			stopTimer(timer)
+		case <-draining.Done():
+			return
+		}
+	}
+}
+
+// maxRuntimeTimer ends the watch with ErrMaxRuntime once maxRuntime has passed. Unlike the deadline, nothing
+// moves or stops it.
+func maxRuntimeTimer(draining context.Context, resultCh chan<- result, opt *options) {
+	timer := time.NewTimer(opt.maxRuntime)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		deliver(draining, resultCh, result{err: fmt.Errorf("%w: ran for %s", ErrMaxRuntime, opt.maxRuntime)})
+	case <-draining.Done():
+		return
+	}
+}
+
+// awaitingFiles reports whether a watch that requires files is still waiting for the first one to arrive
+func (d *dir) awaitingFiles(opt *options) bool {
+	if opt.requireFiles <= 0 || opt.untilChange || d.initial > 0 {
+		return false
+	}
+	created, _ := d.totals()
+	return created == 0
+}
+
+// noFilesMonitor ends the watch with ErrNoFiles if no file has arrived once requireFiles has passed
+func noFilesMonitor(d *dir, draining context.Context, resultCh chan<- result, opt *options) {
+	timer := time.NewTimer(opt.requireFiles)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		if !d.awaitingFiles(opt) {
+			return
+		}
+		err := fmt.Errorf("%w: none arrived within %s", ErrNoFiles, opt.requireFiles)
+		deliver(draining, resultCh, result{err: err})
+	case <-draining.Done():
+		return
+	}
+}
+
+// deliver offers res as the result of a watch, then waits for the watch to end.
+// Only the first result delivered is taken. Any others are dropped once the watch cancels draining,
+// so goroutines whose conditions fire at the same time never block or send on a finished watch.
+func deliver(draining context.Context, resultCh chan<- result, res result) {
+	select {
+	case resultCh <- res:
+	case <-draining.Done():
+	}
+	<-draining.Done()
+}
+
+// stopMonitor ends the watch with ErrCanceled when d is stopped
+func stopMonitor(d *dir, draining context.Context, resultCh chan<- result) {
+	select {
+	case <-d.stop:
+		deliver(draining, resultCh, result{err: ErrCanceled})
+	case <-draining.Done():
+		return
+	}
+}
+
+// fileCreationMonitor monitors file creation activity.
+// If file creation is too active and the directory is not going to drain, watchdrain will stop.
+// During thresholdWarmup it never stops the watch. When the warmup ends, the net creates so far, if any, become
+// the baseline, and only the net creates past it count toward fileCreates.
+func fileCreationMonitor(d *dir, draining context.Context, resultCh chan<- result, opt *options) {
+	var warmup <-chan time.Time
+	if opt.thresholdWarmup > 0 {
+		timer := time.NewTimer(opt.thresholdWarmup)
+		defer timer.Stop()
+		warmup = timer.C
+	}
+	for {
+		select {
+		case _, ok := <-opt.eventCh:
+			if !ok {
+				return
+			}
+		case <-warmup:
+			warmup = nil
+			baseline := d.setCreateBaseline()
+			if opt.verbose {
+				opt.logger.Printf("MONITOR: warmup over with %d net creates\n", baseline)
+			}
+			continue
+		case <-draining.Done():
+			return
+		}
+		if warmup != nil {
+			continue
+		}
+		// created and removed track draining activity; notifications may be coalesced, but the totals are exact.
+		// They are kept on d, so dumpWatches can show how close the watch is to the threshold.
+		creates, removes, net := d.netCreates()
+		if net > int64(opt.fileCreates) { // 1 is the lowest fileCreates
+			if opt.verbose {
+				d.mu.RLock()
+				opt.logger.Printf("MONITOR: %d creates (%d likely moved in), %d removes\n", creates, d.movedIn, removes)
+				d.mu.RUnlock()
+			}
+			deliver(draining, resultCh, result{err: ErrTooManyCreateEvents})
+			return
+		}
+	}
+}
+
+// rateMonitor measures the removal rate over each rateWindow, starting once rateWarmup has passed.
+// Removals during the warm-up are not measured. If fewer files than minRate per second are removed in a window,
+// watchdrain will stop.
+func rateMonitor(d *dir, draining context.Context, resultCh chan<- result, opt *options) {
+	if opt.rateWarmup > 0 {
+		warmup := time.NewTimer(opt.rateWarmup)
+		defer warmup.Stop()
+		select {
+		case <-warmup.C:
+		case <-draining.Done():
+			return
+		}
+	}
+	ticker := time.NewTicker(opt.rateWindow)
+	defer ticker.Stop()
+
+	last := d.removals()
+	for {
+		select {
+		case <-ticker.C:
+			removed := d.removals()
+			rate := float64(removed-last) / opt.rateWindow.Seconds()
+			if opt.verbose {
+				opt.logger.Printf("RATE: %.2f files/s\n", rate)
+			}
+			if rate < opt.minRate {
+				deliver(draining, resultCh, result{err: fmt.Errorf("%w: %.2f files/s", ErrTooSlow, rate)})
+				return
+			}
+			last = removed
+		case <-draining.Done():
+			return
+		}
+	}
+}
+
+// watchMonitor checks that the watch is still in place whenever the watcher has delivered no events for
+// watchCheck. A watch the kernel drops, as when the filesystem goes away, ends silently, so without this check
+// the watch would wait out its deadline. The check is only conclusive when the directory still holds files
+// and the watcher no longer lists it, which is reported as ErrWatchLost.
+func watchMonitor(d *dir, watcher *fsnotify.Watcher, draining context.Context, resultCh chan<- result, opt *options) {
+	ticker := time.NewTicker(opt.watchCheck)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			if d.sinceEvent(start) < opt.watchCheck || watching(watcher, *d.dirName) {
+				continue
+			}
+			files, _, err := readDirFiles(*d.dirName, opt)
+			if err != nil || *files == 0 {
+				continue
+			}
+			if opt.verbose {
+				opt.logger.Printf("HEALTH: %s is no longer watched with %d files left\n", *d.dirName, *files)
+			}
+			err = fmt.Errorf("%w: %s with %d files left", ErrWatchLost, *d.dirName, *files)
+			deliver(draining, resultCh, result{err: err})
+			return
+		case <-draining.Done():
+			return
+		}
+	}
+}
+
+// watching reports whether a watcher is watching a path.
+// A closed watcher lists nil, and counts as watching, since it is only closed once the watch is over.
+func watching(watcher *fsnotify.Watcher, name string) bool {
+	list := watcher.WatchList()
+	if list == nil {
+		return true
+	}
+	for _, watched := range list {
+		if watched == filepath.Clean(name) {
+			return true
 		}
 	}
+	return false
 }
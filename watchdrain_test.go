@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"math"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"go.uber.org/goleak"
 )
 
@@ -89,6 +102,22 @@ func createTempFile(t *testing.T, tmpDir string) *os.File {
 	return f
 }
 
+// newTestOptions is newOptions for tests, which fails the test if newOptions returns an error
+func newTestOptions(t *testing.T, deadline time.Duration, fileCreates uint, verbose bool) *options {
+	t.Helper()
+	opts, err := newOptions(deadline, fileCreates, verbose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// newCountDir returns a dir holding a file count without reading a directory
+func newCountDir(files uint32) *dir {
+	dirName := testDir
+	return &dir{dirName: &dirName, files: &files}
+}
+
 func TestReadDirFiles(t *testing.T) {
 	testPath := createPath(t)
 
@@ -96,7 +125,7 @@ func TestReadDirFiles(t *testing.T) {
 		createTempFile(t, testPath)
 	}
 
-	d, err := newDir(testPath)
+	d, err := newDir(testPath, newTestOptions(t, 0, 0, false))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,10 +137,71 @@ func TestReadDirFiles(t *testing.T) {
 	}
 }
 
+func TestStatDetail(t *testing.T) {
+	testPath := createPath(t)
+	f := createTempFile(t, testPath)
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		ev   event
+		want string
+	}{
+		{"Create", f.Name(), Create, fmt.Sprintf(" (14 bytes, %s, %s)", info.Mode(), info.ModTime().Format(time.TimeOnly))},
+		{"Remove", f.Name(), Remove, ""},
+		{"Missing", filepath.Join(testPath, file1), Create, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statDetail(tt.file, tt.ev); got != tt.want {
+				t.Errorf("Did not get expected result. Wanted: %q, got: %q", tt.want, got)
+			}
+		})
+	}
+
+	subInfo, err := os.Stat(filepath.Join(testPath, sub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(" (%s, %s)", subInfo.Mode(), subInfo.ModTime().Format(time.TimeOnly))
+	if got := statDetail(filepath.Join(testPath, sub), Create); got != want {
+		t.Errorf("Did not get expected result. Wanted: %q, got: %q", want, got)
+	}
+}
+
+func TestNoColor(t *testing.T) {
+	testPath := createPath(t)
+	f, err := os.Create(filepath.Join(testPath, file1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if useColor(f, false) {
+		t.Errorf("Unexpected result. Wanted color off for a file that is not a terminal")
+	}
+	for _, ev := range []event{Create, Remove} {
+		op := fsnotify.Create
+		if ev == Remove {
+			op = fsnotify.Remove
+		}
+		if got := formatOp(op, ev, false); strings.Contains(got, "\x1b") {
+			t.Errorf("Unexpected escape code in %q", got)
+		}
+		if got := formatOp(op, ev, true); !strings.Contains(got, "\x1b") {
+			t.Errorf("Missing escape code in %q", got)
+		}
+	}
+}
+
 func TestEmpty(t *testing.T) {
 	testPath := createPath(t)
 
-	d, err := newDir(testPath)
+	d, err := newDir(testPath, newTestOptions(t, 0, 0, false))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -123,16 +213,159 @@ func TestEmpty(t *testing.T) {
 	}
 }
 
+func TestOpEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    fsnotify.Op
+		files uint32
+		want  uint32
+	}{
+		{"Create", fsnotify.Create, 1, 2},
+		{"Remove", fsnotify.Remove, 1, 0},
+		{"RemoveEmpty", fsnotify.Remove, 0, 0},
+		{"CreateRemove", fsnotify.Create | fsnotify.Remove, 1, 0},
+		{"CreateRename", fsnotify.Create | fsnotify.Rename, 1, 2},
+		{"RemoveWrite", fsnotify.Remove | fsnotify.Write, 1, 0},
+		{"Write", fsnotify.Write, 1, 1},
+		{"Chmod", fsnotify.Chmod, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newCountDir(tt.files)
+			if ev, ok := opEvent(tt.op); ok {
+				d.apply(ev)
+			}
+			if got := *d.files; got != tt.want {
+				t.Errorf("Did not get expected result. Wanted: %d, got: %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRemoveUnderflow(t *testing.T) {
+	d := newCountDir(2)
+	for i := 0; i < 3; i++ {
+		d.apply(Remove)
+	}
+	want := uint32(0)
+	got, clamped := d.apply(Remove)
+	if got != want || !clamped {
+		t.Errorf("Did not get expected result. Wanted: %d clamped, got: %d clamped:%t", want, got, clamped)
+	}
+	if !d.isEmpty() {
+		t.Errorf("Did not get expected result. Wanted an empty directory")
+	}
+}
+
+func TestEmptyFastPath(t *testing.T) {
+	testPath := createPath(t)
+
+	watched := false
+	newWatcher = func() (*fsnotify.Watcher, error) {
+		watched = true
+		return fsnotify.NewWatcher()
+	}
+	defer func() { newWatcher = fsnotify.NewWatcher }()
+
+	opts := newTestOptions(t, (1 * time.Minute), 1, false)
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.watchDrain(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != true {
+		t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+	}
+	if watched {
+		t.Errorf("Unexpected result. Wanted no watcher for an empty directory")
+	}
+}
+
+func TestWatchError(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher := &fsnotify.Watcher{Events: make(chan fsnotify.Event), Errors: make(chan error)}
+	draining, cancel := context.WithCancel(context.Background())
+	resultCh := make(chan result)
+	go drainer(d, watcher, draining, resultCh, opts)
+
+	injected := errors.New("injected")
+	watcher.Errors <- injected
+	res := <-resultCh
+	cancel()
+
+	var got WatchError
+	if !errors.As(res.err, &got) {
+		t.Fatalf("Unexpected result. Wanted a WatchError, got: %v", res.err)
+	}
+	if got.Dir != testPath || !errors.Is(res.err, injected) {
+		t.Errorf("Unexpected result. Wanted: %s %s, got: %s %s", testPath, injected, got.Dir, got.Err)
+	}
+}
+
+func TestNewWatcherError(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	newWatcher = func() (*fsnotify.Watcher, error) { return nil, syscall.EMFILE }
+	defer func() { newWatcher = fsnotify.NewWatcher }()
+
+	// The failure ends this watch with a WatchError rather than exiting the process
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	res := watchOne(context.Background(), testPath, opts)
+	if res.Drained || res.Reason != "watcher error" || !strings.Contains(res.Error, syscall.EMFILE.Error()) {
+		t.Errorf("Unexpected result. Wanted a watcher error, got: %+v", res)
+	}
+	if got := exitCode([]JSONResult{res}); got != exitError {
+		t.Errorf("Unexpected result. Wanted exit code: %d, got: %d", exitError, got)
+	}
+}
+
+func TestSetupTimeout(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	hang := make(chan struct{})
+	watcherAdd = func(w *fsnotify.Watcher, name string) error {
+		<-hang
+		return w.Add(name)
+	}
+	defer func() {
+		close(hang)
+		watcherAdd = (*fsnotify.Watcher).Add
+	}()
+
+	want := ErrSetupTimeout
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.setupTimeout = 10 * time.Millisecond
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+	}
+}
+
 func TestDeadline(t *testing.T) {
 	testPath := createPath(t)
 	createSeedFiles(t, testPath)
 
 	want := ErrTimeout
-	d, err := newDir(testPath)
+	opts := newTestOptions(t, (50 * time.Millisecond), 0, false)
+	d, err := newDir(testPath, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
-	opts := newOptions((50 * time.Millisecond), 0, false)
 	if _, got := d.watchDrain(opts); got != nil {
 		if !errors.Is(got, want) {
 			t.Errorf("Unexpected result. Wanted: %s, got: %s", want, got)
@@ -140,6 +373,21 @@ func TestDeadline(t *testing.T) {
 	}
 }
 
+func TestZeroDeadline(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	want := ErrNoDeadline
+	opts := newTestOptions(t, 0, 0, false)
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+	}
+}
+
 func TestDrainNoCreates(t *testing.T) {
 	testPath := createPath(t)
 	createSeedFiles(t, testPath)
@@ -147,11 +395,12 @@ func TestDrainNoCreates(t *testing.T) {
 	t.Run("Watch", func(t *testing.T) {
 		t.Parallel()
 
-		d, err := newDir(testPath)
+		opts := newTestOptions(t, 0, 0, false)
+		opts.noDeadline = true
+		d, err := newDir(testPath, opts)
 		if err != nil {
 			t.Fatal(err)
 		}
-		opts := newOptions(0, 0, false)
 		got, err := d.watchDrain(opts)
 		if err != nil {
 			t.Fatal(err)
@@ -183,11 +432,11 @@ func TestDrainWithCreates(t *testing.T) {
 	t.Run("Watch", func(t *testing.T) {
 		t.Parallel()
 
-		d, err := newDir(testPath)
+		opts := newTestOptions(t, (1 * time.Minute), math.MaxUint32, true)
+		d, err := newDir(testPath, opts)
 		if err != nil {
 			t.Fatal(err)
 		}
-		opts := newOptions((1 * time.Minute), math.MaxUint32, true)
 		got, err := d.watchDrain(opts)
 		if err != nil {
 			t.Fatal(err)
@@ -233,11 +482,11 @@ func TestNotDraining(t *testing.T) {
 		t.Parallel()
 
 		want := ErrTooManyCreateEvents
-		d, err := newDir(testPath)
+		opts := newTestOptions(t, (1 * time.Minute), 1, true)
+		d, err := newDir(testPath, opts)
 		if err != nil {
 			t.Fatal(err)
 		}
-		opts := newOptions((1 * time.Minute), 1, true)
 		if _, got := d.watchDrain(opts); got != nil {
 			if !errors.Is(got, want) {
 				t.Errorf("Unexpected result. Wanted: %s, got: %s", want, got)
@@ -262,3 +511,2884 @@ func TestNotDraining(t *testing.T) {
 		createTempFile(t, testPath)
 	})
 }
+
+func TestMaxFilesAtStart(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	want := ErrTooManyFiles
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.maxFiles = 1
+	if _, got := newDir(testPath, opts); !errors.Is(got, want) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+	}
+}
+
+func TestMaxFilesGrow(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrTooManyFiles
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.maxFiles = 2
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		createTempFile(t, testPath)
+	})
+}
+
+func TestParseExts(t *testing.T) {
+	want := []string{".gz", ".csv"}
+	got := parseExts("gz, .csv,,")
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Did not get expected result. Wanted: %q, got: %q", want, got)
+	}
+}
+
+func TestExtCount(t *testing.T) {
+	testPath := createPath(t)
+	for _, name := range []string{"a.gz", "b.csv", "c.txt", "d.GZ"} {
+		if err := os.WriteFile(filepath.Join(testPath, name), []byte("ready to drain"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		exts          string
+		caseSensitive bool
+		want          uint32
+	}{
+		{"All", "", false, 4},
+		{"CaseInsensitive", "gz,.csv", false, 3},
+		{"CaseSensitive", "gz,.csv", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOptions(t, 0, 0, false)
+			opts.exts = parseExts(tt.exts)
+			opts.extCaseSensitive = tt.caseSensitive
+			d, err := newDir(testPath, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := *d.files; got != tt.want {
+				t.Errorf("Did not get expected result. Wanted: %d, got: %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDrainExt(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	for _, name := range []string{"a.gz", "b.GZ"} {
+		if err := os.WriteFile(filepath.Join(testPath, name), []byte("ready to drain"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.exts = parseExts("gz")
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// Creating and removing other files does not affect the drain
+		createTempFile(t, testPath)
+		if err := os.Remove(filepath.Join(testPath, file1)); err != nil {
+			t.Error(err)
+		}
+
+		time.Sleep(time.Millisecond)
+		if err := os.Remove(filepath.Join(testPath, "a.gz")); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := os.Remove(filepath.Join(testPath, "b.GZ")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestConfirm(t *testing.T) {
+	c := confirmer{need: 2}
+	counts := []uint32{2, 0, 1, 0, 0}
+	wants := []bool{false, false, false, false, true}
+	for i, files := range counts {
+		if got := c.observe(files); got != wants[i] {
+			t.Errorf("Unexpected result at poll %d. Wanted: %t, got: %t", i, wants[i], got)
+		}
+	}
+}
+
+func TestDrainPoll(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.poll = 10 * time.Millisecond
+		opts.confirm = 3
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+		if _, err := os.Stat(filepath.Join(testPath, file1)); !os.IsNotExist(err) {
+			t.Errorf("Reported drained before %s was removed", file1)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(filepath.Join(testPath, file2)); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := os.Remove(filepath.Join(testPath, file1)); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestTooSlow(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrTooSlow
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.minRate = 100
+		opts.rateWindow = 100 * time.Millisecond
+		opts.rateWarmup = 300 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+		// Nothing is measured during the warm-up, so the first slow window ends after it
+		elapsed := time.Since(start)
+		if elapsed < opts.rateWarmup+opts.rateWindow {
+			t.Errorf("Unexpected result. Wanted %s after the warm-up and a window, got it after %s", want, elapsed)
+		}
+		if elapsed > opts.deadline/2 {
+			t.Errorf("Unexpected result. Wanted %s before the deadline, got it after %s", want, elapsed)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(filepath.Join(testPath, file1)); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRemoveBurst(t *testing.T) {
+	const n = 1000
+	d := newCountDir(n)
+	opts := newTestOptions(t, 0, 0, false)
+
+	burst := make([]fsnotify.Event, 0, n+1)
+	for i := 0; i < n; i++ {
+		burst = append(burst, fsnotify.Event{Name: fmt.Sprintf("temp.%d.txt", i), Op: fsnotify.Remove})
+	}
+	burst = append(burst, fsnotify.Event{Name: "temp.txt", Op: fsnotify.Create})
+	if _, err := d.countEvents(burst, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := uint32(1)
+	if got := d.count(); got != want {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", want, got)
+	}
+}
+
+func TestCollectBurstCap(t *testing.T) {
+	remove := fsnotify.Event{Name: "temp.txt", Op: fsnotify.Remove}
+
+	// A backlog of removes is cut at readDirBatch events
+	events := make(chan fsnotify.Event, 2*readDirBatch)
+	for i := 0; i < cap(events); i++ {
+		events <- remove
+	}
+	if burst, _ := collectBurst(context.Background(), remove, events); len(burst) != readDirBatch {
+		t.Errorf("Did not get expected result. Wanted: %d events, got: %d", readDirBatch, len(burst))
+	}
+
+	// A steady stream of removes is cut at burstMax
+	stream := make(chan fsnotify.Event)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case stream <- remove:
+				// Spin rather than sleep, since a sleep this short can overshoot burstWindow
+				for sent := time.Now(); time.Since(sent) < 50*time.Microsecond; {
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	burst, _ := collectBurst(context.Background(), remove, stream)
+	if elapsed := time.Since(start); elapsed > 20*burstMax || len(burst) >= readDirBatch {
+		t.Errorf("Unexpected result. Wanted the burst cut at %s, got %d events in %s", burstMax, len(burst), elapsed)
+	}
+
+	// Draining ends the burst without waiting out burstMax
+	draining, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	if _, _ = collectBurst(draining, remove, stream); time.Since(start) >= burstMax/2 {
+		t.Errorf("Unexpected result. Wanted the burst ended by draining, got: %s", time.Since(start))
+	}
+}
+
+func TestDrainBurst(t *testing.T) {
+	const n = 1000
+	testPath := createPath(t)
+	for i := 0; i < n; i++ {
+		if err := os.WriteFile(filepath.Join(testPath, fmt.Sprintf("temp.%d.txt", i)), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+		if removed := d.removals(); removed != n {
+			t.Errorf("Did not get expected result. Wanted: %d removes, got: %d", n, removed)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < n; i++ {
+			if err := os.Remove(filepath.Join(testPath, fmt.Sprintf("temp.%d.txt", i))); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestMonitorTrip(t *testing.T) {
+	t.Cleanup(func() { goleak.VerifyNone(t) })
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrTooManyCreateEvents
+		opts := newTestOptions(t, (1 * time.Minute), 1, false)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// Keep creating files after the monitor trips
+		for i := 0; i < 50; i++ {
+			createTempFile(t, testPath)
+		}
+	})
+}
+
+func TestMonitorTripDrainerExits(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	opts := newTestOptions(t, (1 * time.Minute), 1, false)
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The watcher is never closed, so only the end of draining can stop drainer
+	watcher := &fsnotify.Watcher{Events: make(chan fsnotify.Event), Errors: make(chan error)}
+	draining, cancel := context.WithCancel(context.Background())
+	resultCh := make(chan result)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		drainer(d, watcher, draining, resultCh, opts)
+	}()
+	go fileCreationMonitor(d, draining, resultCh, opts)
+
+	for i := 0; i < 2; i++ {
+		watcher.Events <- fsnotify.Event{Name: createTempFile(t, testPath).Name(), Op: fsnotify.Create}
+	}
+	if res := <-resultCh; !errors.Is(res.err, ErrTooManyCreateEvents) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", ErrTooManyCreateEvents, res.err)
+	}
+	cancel()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("drainer did not exit after the monitor tripped")
+	}
+	// drainer closes eventCh as it exits
+	if _, ok := <-opts.eventCh; ok {
+		t.Errorf("Unexpected result. Wanted eventCh closed")
+	}
+}
+
+func TestExtendOnProgress(t *testing.T) {
+	testPath := createPath(t)
+	for i := 0; i < 4; i++ {
+		createTempFile(t, testPath)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (200 * time.Millisecond), 0, true)
+		opts.extendOnProgress = true
+		opts.extendBy = 300 * time.Millisecond
+		opts.maxDeadline = 5 * time.Second
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		entries, err := os.ReadDir(testPath)
+		if err != nil {
+			t.Error(err)
+		}
+		// Draining takes longer than the base deadline
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			time.Sleep(150 * time.Millisecond)
+			if err := os.Remove(filepath.Join(testPath, entry.Name())); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestExtendCeiling(t *testing.T) {
+	testPath := createPath(t)
+	for i := 0; i < 4; i++ {
+		createTempFile(t, testPath)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrTimeout
+		opts := newTestOptions(t, (100 * time.Millisecond), 0, false)
+		opts.extendOnProgress = true
+		opts.extendBy = time.Minute
+		opts.maxDeadline = 250 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Unexpected result. Wanted a timeout at the ceiling, got one after %s", elapsed)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		entries, err := os.ReadDir(testPath)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := os.Remove(filepath.Join(testPath, entries[0].Name())); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUntilChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		change event
+		files  uint32
+		act    func(t *testing.T, testPath string)
+	}{
+		{"Create", Create, 3, func(t *testing.T, testPath string) { createTempFile(t, testPath) }},
+		{"Remove", Remove, 1, func(t *testing.T, testPath string) {
+			if err := os.Remove(filepath.Join(testPath, file1)); err != nil {
+				t.Error(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPath := createPath(t)
+			createSeedFiles(t, testPath)
+
+			t.Run("Watch", func(t *testing.T) {
+				t.Parallel()
+
+				opts := newTestOptions(t, (1 * time.Minute), 0, false)
+				d, err := newDir(testPath, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				change, files, err := d.watchChange(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if change != tt.change || files != tt.files {
+					t.Errorf("Unexpected result. Wanted: %d %d, got: %d %d", tt.change, tt.files, change, files)
+				}
+				// The caller's options are left as they were, for a drain to follow
+				if opts.untilChange {
+					t.Error("Unexpected result. Wanted untilChange left unset on the options")
+				}
+			})
+
+			t.Run("Drain", func(t *testing.T) {
+				t.Parallel()
+
+				time.Sleep(50 * time.Millisecond)
+				tt.act(t, testPath)
+			})
+		})
+	}
+}
+
+func TestUntilChangeTimeout(t *testing.T) {
+	testPath := createPath(t)
+
+	want := ErrTimeout
+	opts := newTestOptions(t, (50 * time.Millisecond), 0, false)
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, got := d.watchChange(opts); !errors.Is(got, want) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+	}
+}
+
+func TestRecursive(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	deep := filepath.Join(testPath, sub, "deep")
+	if err := os.Mkdir(deep, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	createTempFile(t, filepath.Join(testPath, sub))
+	createTempFile(t, deep)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.recursive = true
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.count(); got != 4 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 4, got)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+		entries, err := os.ReadDir(testPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("Reported drained with %d entries left", len(entries))
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// A subdirectory created while watching is counted and watched too
+		added := filepath.Join(testPath, "added")
+		if err := os.Mkdir(added, 0o700); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		createTempFile(t, added)
+
+		for _, file := range []string{file1, file2} {
+			time.Sleep(time.Millisecond)
+			if err := os.Remove(filepath.Join(testPath, file)); err != nil {
+				t.Error(err)
+			}
+		}
+		time.Sleep(time.Millisecond)
+		if err := os.RemoveAll(deep); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := os.RemoveAll(added); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		entries, err := os.ReadDir(filepath.Join(testPath, sub))
+		if err != nil {
+			t.Error(err)
+		}
+		for _, entry := range entries {
+			if err := os.Remove(filepath.Join(testPath, sub, entry.Name())); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestAddSubdirCountsOnce(t *testing.T) {
+	testPath := createPath(t)
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.recursive = true
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	added := filepath.Join(testPath, "added")
+	nested := filepath.Join(added, "nested")
+	if err := os.MkdirAll(nested, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	addedFile := createTempFile(t, added).Name()
+	nestedFile := createTempFile(t, nested).Name()
+	if err := d.addSubdir(watcher, added, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.count(); got != 2 {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", 2, got)
+	}
+	for _, path := range []string{added, nested} {
+		if !d.isWatched(path) {
+			t.Errorf("Unexpected result. Wanted %s watched", path)
+		}
+	}
+
+	// The walk ran after the watches went on, so the Creates queued for what it counted are not counted again
+	burst := []fsnotify.Event{
+		{Name: addedFile, Op: fsnotify.Create},
+		{Name: nested, Op: fsnotify.Create},
+		{Name: nestedFile, Op: fsnotify.Create},
+	}
+	created, err := d.countEvents(burst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 0 {
+		t.Errorf("Unexpected result. Wanted no new subdirectories, got: %v", created)
+	}
+	if got := d.count(); got != 2 {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", 2, got)
+	}
+}
+
+func TestSkippable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fs.ErrPermission, true},
+		{fmt.Errorf("failed to watch directory: %w", fs.ErrNotExist), true},
+		{errors.New("other"), false},
+	}
+	for _, tt := range tests {
+		if got := skippable(tt.err); got != tt.want {
+			t.Errorf("Unexpected result for %s. Wanted: %t, got: %t", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestRecursiveUnreadable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mode 000 directories are not unreadable on Windows")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root can read mode 000 directories")
+	}
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	locked := filepath.Join(testPath, sub)
+	createTempFile(t, locked)
+	if err := os.Chmod(locked, 0o000); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0o700) })
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.recursive = true
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for _, file := range []string{file1, file2} {
+			if err := os.Remove(filepath.Join(testPath, file)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestTrackComplete(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	opts := newTestOptions(t, (1 * time.Minute), 0, true)
+	opts.trackComplete = true
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(testPath, "temp3.txt")
+	steps := []struct {
+		name string
+		op   fsnotify.Op
+		act  func() error
+		want int
+	}{
+		{"Seeded", 0, func() error { return nil }, 2},
+		{"Create", fsnotify.Create, func() error { return os.WriteFile(name, nil, 0o600) }, 2},
+		{"Write", fsnotify.Write, func() error { return os.WriteFile(name, []byte("ready to drain"), 0o600) }, 3},
+		{"Truncate", fsnotify.Write, func() error { return os.Truncate(name, 0) }, 2},
+		{"Chmod", fsnotify.Chmod, func() error { return os.Chmod(name, 0o400) }, 2},
+		{"Remove", fsnotify.Remove, func() error { return os.Remove(filepath.Join(testPath, file1)) }, 1},
+	}
+	for _, step := range steps {
+		if err := step.act(); err != nil {
+			t.Fatal(err)
+		}
+		if step.op != 0 {
+			eventName := name
+			if step.op == fsnotify.Remove {
+				eventName = filepath.Join(testPath, file1)
+			}
+			if _, err := d.countEvents([]fsnotify.Event{{Name: eventName, Op: step.op}}, opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := d.completed(); got != step.want {
+			t.Errorf("Did not get expected result after %s. Wanted: %d, got: %d", step.name, step.want, got)
+		}
+	}
+}
+
+func TestReadDirFilesBatches(t *testing.T) {
+	const n = 3*readDirBatch + 7
+	testPath := createPath(t)
+	for i := 0; i < n; i++ {
+		if err := os.WriteFile(filepath.Join(testPath, fmt.Sprintf("temp.%d.txt", i)), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _, err := readDirFiles(testPath, newTestOptions(t, 0, 0, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := *files; got != n {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", n, got)
+	}
+
+	// The cap stops the read within the first batch
+	want := ErrTooManyFiles
+	opts := newTestOptions(t, 0, 0, false)
+	opts.maxFiles = 10
+	if _, _, got := readDirFiles(testPath, opts); !errors.Is(got, want) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+	}
+
+	// A walk reads subdirectories in batches too, and the dump counts the same files
+	for i := 0; i < readDirBatch+1; i++ {
+		if err := os.WriteFile(filepath.Join(testPath, sub, fmt.Sprintf("temp.%d.txt", i)), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts = newTestOptions(t, 0, 0, false)
+	opts.recursive = true
+	files, subdirs, err := readDirFiles(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *files, uint32(n+readDirBatch+1); got != want || len(subdirs) != 1 {
+		t.Errorf("Did not get expected result. Wanted: %d in 1 subdirectory, got: %d in %v", want, got, subdirs)
+	}
+	if got := countFilesIn(filepath.Join(testPath, sub), opts); got != readDirBatch+1 {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", readDirBatch+1, got)
+	}
+	opts.maxFiles = 10
+	if _, _, got := readDirFiles(testPath, opts); !errors.Is(got, want) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+	}
+}
+
+func TestDrainNamedFiles(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	for _, name := range []string{"a.done", "b.done", "c.done"} {
+		if err := os.WriteFile(filepath.Join(testPath, name), []byte("ready to drain"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.names = parseNames("a.done, b.done,c.done,missing.done")
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.count(); got != 3 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 3, got)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+		if _, err := os.Stat(filepath.Join(testPath, "c.done")); !os.IsNotExist(err) {
+			t.Errorf("Reported drained before c.done was removed")
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for _, name := range []string{"a.done", file1, "b.done", file2} {
+			time.Sleep(time.Millisecond)
+			if err := os.Remove(filepath.Join(testPath, name)); err != nil {
+				t.Error(err)
+			}
+		}
+		createTempFile(t, testPath)
+		time.Sleep(20 * time.Millisecond)
+		if err := os.Remove(filepath.Join(testPath, "c.done")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestMovedIn(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("create kinds are only known on Linux")
+	}
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	outside := filepath.Join(t.TempDir(), "moved.txt")
+	if err := os.WriteFile(outside, []byte("ready to drain"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.logger = log.New(&buf, "", 0)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := d.watchChange(opts); err != nil {
+			t.Fatal(err)
+		}
+		want := filepath.Join(testPath, "moved.txt") + " (likely moved in)"
+		if got := buf.String(); !strings.Contains(got, want) {
+			t.Errorf("Unexpected result. Wanted %q in the event log, got: %q", want, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// The wait also puts the rename's ctime well past the write's mtime, even with coarse timestamps
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Rename(outside, filepath.Join(testPath, "moved.txt")); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOpenedCreate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("create kinds are only known on Linux")
+	}
+	testPath := createPath(t)
+	f := createTempFile(t, testPath)
+	if got := classifyCreate(f.Name()); got != createOpened {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", createOpened, got)
+	}
+}
+
+func TestThresholdPct(t *testing.T) {
+	testPath := createPath(t)
+	for i := 0; i < 4; i++ {
+		createTempFile(t, testPath)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrTooManyCreateEvents
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.thresholdPct = 50
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+		// The ceiling is 6 files, so the trip happens at the 7th
+		if got := d.count(); got != 7 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 7, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			time.Sleep(time.Millisecond)
+			createTempFile(t, testPath)
+		}
+	})
+}
+
+func TestPctCeiling(t *testing.T) {
+	tests := []struct {
+		pct     float64
+		initial uint32
+		want    uint32
+		ok      bool
+	}{
+		{0, 4, 0, false},
+		{50, 4, 6, true},
+		{10, 3, 4, true},
+		{50, 0, 0, false},
+		{1e9, math.MaxUint32 / 2, math.MaxUint32, true},
+		{math.Inf(1), 1, math.MaxUint32, true},
+	}
+	for _, tt := range tests {
+		opt := &options{thresholdPct: tt.pct}
+		if got, ok := opt.pctCeiling(tt.initial); got != tt.want || ok != tt.ok {
+			t.Errorf("Unexpected result for %g%% of %d. Wanted: %d, %t, got: %d, %t", tt.pct, tt.initial,
+				tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+// replaceDir moves a directory aside and moves a new one, holding one file, into its place
+func replaceDir(t *testing.T, testPath string) {
+	t.Helper()
+	replacement := testPath + ".new"
+	if err := os.Mkdir(replacement, 0o700); err != nil {
+		t.Error(err)
+	}
+	createTempFile(t, replacement)
+	if err := os.Rename(testPath, testPath+".old"); err != nil {
+		t.Error(err)
+	}
+	if err := os.Rename(replacement, testPath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDirRemoved(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrDirRemoved
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		replaceDir(t, testPath)
+	})
+}
+
+func TestRewatch(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.rewatch = true
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := d.watchDrain(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != true {
+			t.Errorf("Unexpected result. Wanted: %t, got: %t", true, got)
+		}
+		// The old directory still holds its files
+		entries, err := os.ReadDir(testPath + ".old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 3, len(entries))
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		replaceDir(t, testPath)
+
+		time.Sleep(50 * time.Millisecond)
+		entries, err := os.ReadDir(testPath)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, entry := range entries {
+			if err := os.Remove(filepath.Join(testPath, entry.Name())); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestRewatchEndsWithDrain(t *testing.T) {
+	testPath := createPath(t)
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.rewatch = true
+	opts.setupTimeout = time.Minute
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if err := os.Remove(filepath.Join(testPath, sub)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(testPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// No replacement appears, but the end of draining stops the wait for one long before setupTimeout
+	draining, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := d.rewatch(watcher, draining, opts); !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Unexpected result. Wanted rewatch to return once draining ended, took: %s", elapsed)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	testPath := createPath(t)
+	f := createTempFile(t, testPath)
+	var buf bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.logger = log.New(&buf, "", 0)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		want := "EVENT: " + f.Name()
+		if got := buf.String(); !strings.Contains(got, want) {
+			t.Errorf("Unexpected result. Wanted %q in the event log, got: %q", want, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(f.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestMinDuration(t *testing.T) {
+	testPath := createPath(t)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrTimeout
+		opts := newTestOptions(t, (500 * time.Millisecond), 0, true)
+		opts.minDuration = 250 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The directory starts empty, but the file created during minDuration keeps it from draining
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+		if got := d.count(); got != 1 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 1, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		createTempFile(t, testPath)
+	})
+}
+
+func TestMinDurationEmpty(t *testing.T) {
+	testPath := createPath(t)
+	for _, poll := range []time.Duration{0, 10 * time.Millisecond} {
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.minDuration = 100 * time.Millisecond
+		opts.poll = poll
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		if elapsed := time.Since(start); elapsed < opts.minDuration {
+			t.Errorf("Did not get expected result. Wanted at least: %s, got: %s", opts.minDuration, elapsed)
+		}
+	}
+}
+
+func TestDebug(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+	var buf bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.debug = true
+		opts.logger = log.New(&buf, "", 0)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		got := buf.String()
+		for _, want := range []string{"RAW: WRITE ", "RAW: CHMOD "} {
+			if !strings.Contains(got, want) {
+				t.Errorf("Unexpected result. Wanted %q in the debug log, got: %q", want, got)
+			}
+		}
+		// Writes and chmods are not counted, so they have no event lines
+		for _, unwanted := range []string{"WRITE  EVENT", "CHMOD  EVENT"} {
+			if strings.Contains(got, unwanted) {
+				t.Errorf("Unexpected result. Did not want %q in the event log, got: %q", unwanted, got)
+			}
+		}
+		if got := d.count(); got != 0 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 0, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		f := createTempFile(t, testPath)
+		if err := os.Chmod(f.Name(), 0o644); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		for _, name := range []string{f.Name(), seed.Name()} {
+			if err := os.Remove(name); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestRemoveConfirm(t *testing.T) {
+	testPath := createPath(t)
+	f := createTempFile(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrTimeout
+		opts := newTestOptions(t, (500 * time.Millisecond), 0, true)
+		opts.removeConfirm = 20 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The file is removed and recreated, as in an atomic save, so the directory never drains
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+		if got := d.count(); got != 1 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 1, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+			// Recreate the file after the remove is seen on its own, but before removeConfirm ends
+			time.Sleep(5 * time.Millisecond)
+			if err := os.WriteFile(f.Name(), []byte("saved"), 0o600); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
+
+func TestRemoveConfirmDrain(t *testing.T) {
+	testPath := createPath(t)
+	f := createTempFile(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.removeConfirm = 20 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Errorf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(f.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRemoveConfirmPending(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.removeConfirm = 50 * time.Millisecond
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counting a burst with Removes does not wait out removeConfirm, which only the Removes wait for
+	var burst []fsnotify.Event
+	for _, file := range []string{file1, file2} {
+		name := filepath.Join(testPath, file)
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+		burst = append(burst, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+	}
+	start := time.Now()
+	if _, err := d.countEvents(burst, opts); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= opts.removeConfirm {
+		t.Errorf("Unexpected result. Wanted the burst counted without waiting, took: %s", elapsed)
+	}
+	d.confirmRemoves(opts)
+	if got := d.count(); got != 2 {
+		t.Errorf("Did not get expected result. Wanted: %d before removeConfirm, got: %d", 2, got)
+	}
+	time.Sleep(opts.removeConfirm)
+	d.confirmRemoves(opts)
+	if got := d.count(); got != 0 {
+		t.Errorf("Did not get expected result. Wanted: %d after removeConfirm, got: %d", 0, got)
+	}
+}
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		res  result
+		want Reason
+	}{
+		{result{drained: true}, ReasonDrained},
+		{result{change: Remove}, ReasonChanged},
+		{result{err: ErrTimeout}, ReasonTimeout},
+		{result{err: fmt.Errorf("%w: more than 6 files", ErrTooManyCreateEvents)}, ReasonThreshold},
+		{result{err: fmt.Errorf("%w: more than 6 files", ErrTooManyFiles)}, ReasonThreshold},
+		{result{err: fmt.Errorf("%w: REMOVE /spool", ErrDirRemoved)}, ReasonDirRemoved},
+		{result{err: WatchError{Dir: "/spool", Err: errors.New("queue overflow")}}, ReasonWatcherError},
+		{result{err: fmt.Errorf("%w: /spool with 2 files left", ErrWatchLost)}, ReasonWatcherError},
+		{result{err: context.Canceled}, ReasonCanceled},
+		{result{err: ErrTooSlow}, ReasonTooSlow},
+		{result{err: fmt.Errorf("%w after 2m0s", ErrMaxRuntime)}, ReasonMaxRuntime},
+		{result{err: ErrNoFiles}, ReasonNoFiles},
+		{result{err: fmt.Errorf("%w: watching /spool took longer than 1s", ErrSetupTimeout)}, ReasonSetupTimeout},
+		{result{err: fmt.Errorf("%w: %w", ErrDirUnreadable, os.ErrPermission)}, ReasonDirUnreadable},
+		{result{err: fmt.Errorf("%w: %w", ErrInvalidOptions, ErrNoDeadline)}, ReasonInvalidOptions},
+		{result{err: errors.New("no such file or directory")}, ReasonError},
+	}
+	for _, tt := range tests {
+		if got := tt.res.classify(); got != tt.want {
+			t.Errorf("Did not get expected result for %v. Wanted: %d, got: %d", tt.res.err, tt.want, got)
+		}
+	}
+}
+
+func TestWatchReason(t *testing.T) {
+	empty := createPath(t)
+	full := createPath(t)
+	createTempFile(t, full)
+	tests := []struct {
+		dirName  string
+		deadline time.Duration
+		want     Reason
+	}{
+		{empty, time.Minute, ReasonDrained},
+		{full, 50 * time.Millisecond, ReasonTimeout},
+		{full, 0, ReasonInvalidOptions},
+	}
+	for _, tt := range tests {
+		opts := newTestOptions(t, tt.deadline, 0, false)
+		d, err := newDir(tt.dirName, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.watch(opts).reason; got != tt.want {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", tt.want, got)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	testPath := createPath(t)
+	f := createTempFile(t, testPath)
+	objects := filepath.Join(testPath, ".git", "objects")
+	if err := os.MkdirAll(objects, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		createTempFile(t, objects)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.recursive = true
+		var err error
+		if opts.prune, err = parsePrune(".git, tmp"); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.count(); got != 1 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 1, got)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Errorf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// A pruned subdirectory created while watching is not watched, so its files are not counted
+		tmp := filepath.Join(testPath, "tmp")
+		if err := os.Mkdir(tmp, 0o700); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		createTempFile(t, tmp)
+		createTempFile(t, objects)
+		if err := os.Remove(f.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestParsePrune(t *testing.T) {
+	if _, err := parsePrune(".git,[tmp"); err == nil {
+		t.Errorf("Unexpected result. Wanted an error for a malformed pattern, got: %v", err)
+	}
+}
+
+func TestWatchLost(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	watchers := make(chan *fsnotify.Watcher, 1)
+	newWatcher = func() (*fsnotify.Watcher, error) {
+		w, err := fsnotify.NewWatcher()
+		watchers <- w
+		return w, err
+	}
+	defer func() { newWatcher = fsnotify.NewWatcher }()
+
+	// Removing the watch drops it silently, as when the kernel drops a watch
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := <-watchers
+		time.Sleep(20 * time.Millisecond)
+		if err := w.Remove(testPath); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	want := ErrWatchLost
+	opts := newTestOptions(t, (5 * time.Second), 0, true)
+	opts.watchCheck = 50 * time.Millisecond
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+	}
+	<-done
+}
+
+func TestStop(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	opts := newTestOptions(t, (1 * time.Minute), 1, false)
+	opts.watchCheck = time.Minute
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := d.watchDrain(opts)
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	d.Stop()
+	d.Stop()
+
+	want := ErrCanceled
+	select {
+	case got := <-errCh:
+		if !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Unexpected result. Wanted a prompt return after Stop")
+	}
+}
+
+func TestCountIf(t *testing.T) {
+	testPath := createPath(t)
+	big := filepath.Join(testPath, "big.txt")
+	small := filepath.Join(testPath, "small.txt")
+	if err := os.WriteFile(big, []byte("more than ten bytes"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(small, []byte("tiny"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	grown := filepath.Join(testPath, "grown.txt")
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.countIf = func(entry fs.DirEntry) bool {
+			info, err := entry.Info()
+			return err == nil && info.Size() > 10
+		}
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.count(); got != 1 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 1, got)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		// The small file's remove was not counted, so the drain waited for the grown file
+		if _, err := os.Stat(grown); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Reported drained before %s was removed", grown)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// An empty file is not counted until it grows past ten bytes
+		if err := os.WriteFile(grown, nil, 0o600); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := os.WriteFile(grown, []byte("more than ten bytes"), 0o600); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		for _, name := range []string{small, big} {
+			if err := os.Remove(name); err != nil {
+				t.Error(err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(grown); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestDirUnreadable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mode 000 directories are not unreadable on Windows")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root can read mode 000 directories")
+	}
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	t.Cleanup(func() { os.Chmod(testPath, 0o700) })
+	var buf bytes.Buffer
+
+	t.Run("Poll", func(t *testing.T) {
+		t.Parallel()
+
+		want := ErrDirUnreadable
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.poll = 20 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		// Without re-reads the watch goes on, warning that the directory is unreadable
+		want := ErrTimeout
+		opts := newTestOptions(t, (300 * time.Millisecond), 0, true)
+		opts.logger = log.New(&buf, "", 0)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+		if got := buf.String(); !strings.Contains(got, "is unreadable") {
+			t.Errorf("Unexpected result. Wanted an unreadable warning, got: %q", got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(100 * time.Millisecond)
+		if err := os.Chmod(testPath, 0o000); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestEventLogSequence(t *testing.T) {
+	testPath := createPath(t)
+	var files []*os.File
+	for i := 0; i < 6; i++ {
+		files = append(files, createTempFile(t, testPath))
+	}
+	var buf bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.logger = log.New(&buf, "", 0)
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != len(files) {
+			t.Fatalf("Did not get expected result. Wanted: %d lines, got: %q", len(files), lines)
+		}
+		remaining := len(files)
+		for i, line := range lines {
+			var seq, got int
+			if _, err := fmt.Sscanf(line, "#%d", &seq); err != nil || seq != i+1 {
+				t.Errorf("Unexpected result. Wanted sequence number %d, got: %q", i+1, line)
+			}
+			if _, err := fmt.Sscanf(line[strings.LastIndex(line, "->"):], "-> %d remaining", &got); err != nil {
+				t.Fatalf("Unexpected result. Wanted a remaining count, got: %q", line)
+			}
+			if remaining--; got != remaining {
+				t.Errorf("Did not get expected result. Wanted: %d remaining, got: %q", remaining, line)
+			}
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// Removes in quick succession are counted as bursts, alongside ones spaced apart
+		for i, f := range files {
+			if i%2 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestListInitial(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	if err := os.WriteFile(filepath.Join(testPath, "skipped.csv"), []byte("not counted"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.exts = parseExts("txt")
+	opts.listInitial = true
+	opts.logger = log.New(&buf, "", 0)
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _, err := readDirFiles(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{file1, file2}
+	if len(d.initialFiles) != int(*files) || !reflect.DeepEqual(d.initialFiles, want) {
+		t.Errorf("Unexpected result. Wanted %d files: %q, got: %q", *files, want, d.initialFiles)
+	}
+	if got := buf.String(); got != "INITIAL: "+file1+"\nINITIAL: "+file2+"\n" {
+		t.Errorf("Unexpected result. Wanted the initial files logged, got: %q", got)
+	}
+}
+
+// startDeadlineTimer runs a deadlineTimer until the test ends, returning it and its result channel
+func startDeadlineTimer(t *testing.T, d time.Duration) (*deadlineTimer, <-chan result) {
+	t.Helper()
+	draining, cancel := context.WithCancel(context.Background())
+	resultCh := make(chan result, 1)
+	timer := newDeadlineTimer(d)
+	go timer.run(draining, resultCh)
+	t.Cleanup(func() {
+		cancel()
+		<-timer.done
+	})
+	return timer, resultCh
+}
+
+func TestDeadlineTimer(t *testing.T) {
+	t.Run("Fixed", func(t *testing.T) {
+		t.Parallel()
+
+		_, resultCh := startDeadlineTimer(t, 20*time.Millisecond)
+		select {
+		case res := <-resultCh:
+			if !errors.Is(res.err, ErrTimeout) {
+				t.Errorf("Unexpected result. Wanted: %s, got: %v", ErrTimeout, res.err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Unexpected result. Wanted the deadline to pass")
+		}
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		t.Parallel()
+
+		timer, resultCh := startDeadlineTimer(t, 50*time.Millisecond)
+		start := time.Now()
+		time.Sleep(20 * time.Millisecond)
+		timer.Reset(150 * time.Millisecond)
+		<-resultCh
+		if elapsed := time.Since(start); elapsed < 170*time.Millisecond {
+			t.Errorf("Unexpected result. Wanted the reset deadline to pass after 170ms, got: %s", elapsed)
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		t.Parallel()
+
+		timer, resultCh := startDeadlineTimer(t, 20*time.Millisecond)
+		timer.Stop()
+		select {
+		case res := <-resultCh:
+			t.Fatalf("Unexpected result. Wanted no result after Stop, got: %v", res.err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		// A stopped deadline restarts on Reset
+		timer.Reset(10 * time.Millisecond)
+		select {
+		case <-resultCh:
+		case <-time.After(time.Second):
+			t.Error("Unexpected result. Wanted the deadline to pass after Reset")
+		}
+	})
+
+	t.Run("Done", func(t *testing.T) {
+		t.Parallel()
+
+		// Controls sent after run returns do not block
+		draining, cancel := context.WithCancel(context.Background())
+		cancel()
+		timer := newDeadlineTimer(time.Minute)
+		timer.run(draining, make(chan result))
+		timer.Reset(time.Second)
+		timer.Stop()
+	})
+}
+
+func TestRequireFiles(t *testing.T) {
+	for _, poll := range []time.Duration{0, 10 * time.Millisecond} {
+		testPath := createPath(t)
+		want := ErrNoFiles
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.requireFiles = 100 * time.Millisecond
+		opts.poll = poll
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+	}
+}
+
+func TestRequireFilesArrive(t *testing.T) {
+	testPath := createPath(t)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.requireFiles = 200 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Errorf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		if created, removed := d.totals(); created != 1 || removed != 1 {
+			t.Errorf("Did not get expected result. Wanted: 1 created and removed, got: %d, %d", created, removed)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		f := createTempFile(t, testPath)
+		time.Sleep(10 * time.Millisecond)
+		if err := os.Remove(f.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestDeliverRace(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		draining, cancel := context.WithCancel(context.Background())
+		resultCh := make(chan result)
+		var senders sync.WaitGroup
+		for _, err := range []error{ErrTimeout, ErrTooManyCreateEvents, ErrTooSlow, ErrCanceled} {
+			senders.Add(1)
+			go func(err error) {
+				defer senders.Done()
+				deliver(draining, resultCh, result{err: err})
+			}(err)
+		}
+		res := <-resultCh
+		cancel()
+		senders.Wait()
+		if res.err == nil {
+			t.Fatalf("Unexpected result. Wanted one of the delivered errors, got: %v", res.err)
+		}
+	}
+}
+
+func TestWatchResultRace(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+	// The deadline and the rate monitor trip at the same moment, again and again
+	for i := 0; i < 50; i++ {
+		opts := newTestOptions(t, time.Millisecond, 0, false)
+		opts.minRate = 1
+		opts.rateWindow = time.Millisecond
+		opts.rateWarmup = 0
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.watchDrain(opts); !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrTooSlow) {
+			t.Fatalf("Unexpected result. Wanted: %s or %s, got: %v", ErrTimeout, ErrTooSlow, err)
+		}
+	}
+}
+
+func TestOps(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		var err error
+		if opts.ops, err = parseOps("remove"); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The created file is not counted, so removing the seed file drains the directory
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Errorf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		if created, _ := d.totals(); created != 0 {
+			t.Errorf("Did not get expected result. Wanted: %d created, got: %d", 0, created)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		createTempFile(t, testPath)
+		time.Sleep(10 * time.Millisecond)
+		if err := os.Remove(seed.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOpsRecount(t *testing.T) {
+	testPath := createPath(t)
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.ops = fsnotify.Remove
+	opts.derefSymlinks = true
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Re-checking files on every event does not let a create in, through its own event or a later write
+	created := createTempFile(t, testPath).Name()
+	burst := []fsnotify.Event{
+		{Name: created, Op: fsnotify.Create},
+		{Name: created, Op: fsnotify.Write},
+		{Name: created, Op: fsnotify.Chmod},
+	}
+	if _, err := d.countEvents(burst, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.count(); got != 0 {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", 0, got)
+	}
+	if created, _ := d.totals(); created != 0 {
+		t.Errorf("Did not get expected result. Wanted: %d created, got: %d", 0, created)
+	}
+}
+
+func TestOpsRename(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+	outside := filepath.Join(t.TempDir(), "moved.txt")
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.ops = fsnotify.Create | fsnotify.Remove | fsnotify.Rename
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Moving the file out of the directory counts as removing it
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Errorf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Rename(seed.Name(), outside); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestParseOps(t *testing.T) {
+	if got, err := parseOps("create, Rename"); err != nil || got != fsnotify.Create|fsnotify.Rename {
+		t.Errorf("Unexpected result. Wanted: %s, got: %s, %v", fsnotify.Create|fsnotify.Rename, got, err)
+	}
+	for _, list := range []string{"write", ""} {
+		if _, err := parseOps(list); err == nil {
+			t.Errorf("Unexpected result. Wanted an error for %q, got: %v", list, err)
+		}
+	}
+}
+
+func TestMtimeStable(t *testing.T) {
+	testPath := createPath(t)
+	createTempFile(t, testPath)
+	lastChange := make(chan time.Time, 1)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (5 * time.Second), 0, true)
+		opts.mtimeStable = 200 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The directory settles with files left, since its file count does not matter
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		if elapsed := time.Since(<-lastChange); elapsed < opts.mtimeStable {
+			t.Errorf("Did not get expected result. Wanted settled at least: %s after the last change, got: %s",
+				opts.mtimeStable, elapsed)
+		}
+		if got := d.count(); got != 4 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 4, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// Keep the directory changing for a while before it stops
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			createTempFile(t, testPath)
+		}
+		lastChange <- time.Now()
+	})
+}
+
+func TestMtimeStableTiny(t *testing.T) {
+	// A tenth of 5ns is 0, which a ticker does not take, so the stat interval has a floor
+	testPath := createPath(t)
+	opts := newTestOptions(t, (5 * time.Second), 0, false)
+	opts.mtimeStable = 5 * time.Nanosecond
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drained, err := d.watchDrain(opts); !drained || err != nil {
+		t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+	}
+}
+
+func TestMtimeStableTimeout(t *testing.T) {
+	testPath := createPath(t)
+	want := ErrTimeout
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (300 * time.Millisecond), 0, false)
+		opts.mtimeStable = 200 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := d.watchDrain(opts); !errors.Is(got, want) {
+			t.Errorf("Unexpected result. Wanted: %s, got: %v", want, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// The directory never stays unchanged for the window before the deadline
+		for i := 0; i < 6; i++ {
+			time.Sleep(50 * time.Millisecond)
+			createTempFile(t, testPath)
+		}
+	})
+}
+
+func TestStatusLine(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+	var buf bytes.Buffer
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.status = &buf
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		// The status line is redrawn in place and cleared by the time the watch returns
+		got := buf.String()
+		if want := "\r\x1b[K⠋ " + testPath + "  1 files  00:00"; !strings.HasPrefix(got, want) {
+			t.Errorf("Unexpected result. Wanted prefix: %q, got: %q", want, got)
+		}
+		if !strings.HasSuffix(got, "\r\x1b[K") {
+			t.Errorf("Unexpected result. Wanted the status line cleared, got: %q", got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(250 * time.Millisecond)
+		if err := os.Remove(seed.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestStatusLineNotTerminal(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+	out, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.status = statusLine(out, true)
+		opts.logger = log.New(out, "", 0)
+		if opts.status != nil {
+			t.Fatalf("Unexpected result. Wanted no status line for a file, got: %v", opts.status)
+		}
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		got, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.ContainsAny(got, "\r\x1b") {
+			t.Errorf("Unexpected result. Wanted no carriage returns or ANSI codes, got: %q", got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(150 * time.Millisecond)
+		if err := os.Remove(seed.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestFormatStatus(t *testing.T) {
+	want := "⠙ /x  17 files  01:42"
+	if got := formatStatus('⠙', "/x", 17, 102500*time.Millisecond); got != want {
+		t.Errorf("Unexpected result. Wanted: %q, got: %q", want, got)
+	}
+}
+
+func TestOwnerOnly(t *testing.T) {
+	if !ownerOnlySupported {
+		t.Skip("Skipping test: file ownership is not supported on this platform")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("Skipping test: giving files to another user needs root")
+	}
+	testPath := createPath(t)
+	mine := createTempFile(t, testPath)
+	theirs := createTempFile(t, testPath)
+	// nobody owns the other user's files
+	if err := os.Chown(theirs.Name(), 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.countIf = ownedByCurrentUser
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := d.count(); got != 1 {
+			t.Errorf("Did not get expected result. Wanted: %d, got: %d", 1, got)
+		}
+		// Only removing the current user's file drains the directory
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		if _, err := os.Stat(theirs.Name()); err != nil {
+			t.Errorf("Unexpected result. Wanted %s left in place, got: %v", theirs.Name(), err)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// A file created and then given to another user stops counting
+		other := createTempFile(t, testPath)
+		time.Sleep(10 * time.Millisecond)
+		if err := os.Chown(other.Name(), 65534, 65534); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := os.Remove(mine.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestNewOptions(t *testing.T) {
+	if _, err := newOptions(-time.Second, 0, false); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", ErrInvalidOptions, err)
+	}
+	// A zero deadline is left for validate to reject unless noDeadline is set
+	opts, err := newOptions(0, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.eventCh == nil {
+		t.Errorf("Unexpected result. Wanted an eventCh for a fileCreates threshold")
+	}
+	if err := opts.validate(); !errors.Is(err, ErrInvalidOptions) || !errors.Is(err, ErrNoDeadline) {
+		t.Errorf("Unexpected result. Wanted: %s and %s, got: %v", ErrInvalidOptions, ErrNoDeadline, err)
+	}
+	opts.noDeadline = true
+	if err := opts.validate(); err != nil {
+		t.Errorf("Unexpected result. Wanted the defaults to be valid, got: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*options)
+		want string
+	}{
+		{"zero deadline", func(o *options) { o.deadline = 0 }, "deadline must be greater than zero"},
+		{"negative poll", func(o *options) { o.poll = -time.Second }, "poll -1s is negative"},
+		{"negative setup timeout", func(o *options) { o.setupTimeout = -time.Second }, "setup-timeout"},
+		{"negative watch check", func(o *options) { o.watchCheck = -time.Second }, "watch-check"},
+		{"negative remove confirm", func(o *options) { o.removeConfirm = -time.Second }, "remove-confirm"},
+		{"negative require files", func(o *options) { o.requireFiles = -time.Second }, "require-files"},
+		{"negative min duration", func(o *options) { o.minDuration = -time.Second }, "min-duration"},
+		{"negative mtime stable", func(o *options) { o.mtimeStable = -time.Second }, "mtime-stable"},
+		{"no logger", func(o *options) { o.logger = nil }, "no logger"},
+		{"threshold without eventCh", func(o *options) { o.fileCreates = 1 }, "without an eventCh"},
+		{"threshold with poll", func(o *options) {
+			o.fileCreates, o.eventCh, o.poll = 1, make(chan struct{}, 1), time.Second
+		}, "cannot be used with poll"},
+		{"threshold with mtime stable", func(o *options) {
+			o.fileCreates, o.eventCh, o.mtimeStable = 1, make(chan struct{}, 1), time.Second
+		}, "cannot be used with poll or mtime-stable"},
+		{"removed with poll", func(o *options) { o.removedGoal, o.poll = 1, time.Second }, "removed counts remove events"},
+		{"no ops", func(o *options) { o.ops = 0 }, "ops"},
+		{"uncountable op", func(o *options) { o.ops = fsnotify.Write }, "ops"},
+		{"negative threshold pct", func(o *options) { o.thresholdPct = -1 }, "threshold-pct"},
+		{"zero confirm", func(o *options) { o.confirm = 0 }, "confirm"},
+		{"negative min rate", func(o *options) { o.minRate = -1 }, "min-rate -1 is negative"},
+		{"min rate without window", func(o *options) { o.minRate, o.rateWindow = 1, 0 }, "min-rate-window"},
+		{"zero extend fraction", func(o *options) { o.extendOnProgress, o.extendFraction = true, 0 }, "extend-fraction"},
+		{"extend fraction over 1", func(o *options) { o.extendOnProgress, o.extendFraction = true, 1.5 }, "extend-fraction"},
+		{"zero extend by", func(o *options) { o.extendOnProgress, o.extendBy = true, 0 }, "extend-by"},
+		{"max deadline before deadline", func(o *options) {
+			o.extendOnProgress, o.maxDeadline = true, time.Second
+		}, "max-deadline 1s is before the deadline 1m0s"},
+		{"baseline with poll", func(o *options) { o.baseline, o.poll = true, time.Second }, "baseline tracks files"},
+		{"baseline with deref symlinks", func(o *options) { o.baseline, o.derefSymlinks = true, true }, "deref-symlinks"},
+		{"negative older than", func(o *options) { o.olderThan = -time.Second }, "older-than"},
+		{"warmup without threshold", func(o *options) { o.thresholdWarmup = time.Second }, "threshold-warmup"},
+		{"remove dir alone", func(o *options) { o.removeDir = true }, "remove-dir"},
+		{"strict preflight alone", func(o *options) { o.strictPreflight = true }, "strict-preflight"},
+		{"negative max runtime", func(o *options) { o.maxRuntime = -time.Second }, "max-runtime"},
+		{"prune without recursive", func(o *options) { o.prune = []string{".git"} }, "prune"},
+		{"stream without interval", func(o *options) { o.stream, o.streamInterval = io.Discard, 0 }, "json-stream-interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := newTestOptions(t, (1 * time.Minute), 0, false)
+			tt.set(opts)
+			err := opts.validate()
+			if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Unexpected result. Wanted: %s with %q, got: %v", ErrInvalidOptions, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestWatchInvalidOptions(t *testing.T) {
+	testPath := createPath(t)
+	createTempFile(t, testPath)
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.confirm = 0
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := d.watch(opts)
+	if !errors.Is(res.err, ErrInvalidOptions) || res.reason != ReasonInvalidOptions {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", ErrInvalidOptions, res.err)
+	}
+}
+
+func TestRemovedGoal(t *testing.T) {
+	testPath := createPath(t)
+	var files []*os.File
+	for i := 0; i < 10; i++ {
+		files = append(files, createTempFile(t, testPath))
+	}
+	extra := createTempFile(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.removedGoal = 100
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		// The watch ends at the 100th removal, with files left and before the next removal
+		if got := d.removals(); got != 100 {
+			t.Errorf("Did not get expected result. Wanted: %d removals, got: %d", 100, got)
+		}
+		if got := d.count(); got != 11 {
+			t.Errorf("Did not get expected result. Wanted: %d files left, got: %d", 11, got)
+		}
+		if _, err := os.Stat(extra.Name()); err != nil {
+			t.Errorf("Reported drained after %s was removed", extra.Name())
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// Files keep arriving as they are removed, so the directory never empties
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < 100; i++ {
+			files = append(files, createTempFile(t, testPath))
+			if err := os.Remove(files[i].Name()); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if err := os.Remove(extra.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestBaseline(t *testing.T) {
+	testPath := createPath(t)
+	originals := []*os.File{createTempFile(t, testPath), createTempFile(t, testPath)}
+	var arrivals []*os.File
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.baseline = true
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		// The drain waited for the originals, and the files that arrived later are still there
+		for _, f := range originals {
+			if _, err := os.Stat(f.Name()); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Reported drained before %s was removed", f.Name())
+			}
+		}
+		if files, _, err := readDirFiles(testPath, opts); err != nil || *files != 2 {
+			t.Errorf("Did not get expected result. Wanted: %d files left, got: %v, %v", 2, files, err)
+		}
+		if created, removed := d.totals(); created != 4 || removed != 4 {
+			t.Errorf("Did not get expected result. Wanted: 4 created and 4 removed, got: %d and %d", created, removed)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			arrivals = append(arrivals, createTempFile(t, testPath))
+		}
+		// Removing a later file, and recreating an original under its name, do not count
+		if err := os.Remove(arrivals[0].Name()); err != nil {
+			t.Error(err)
+		}
+		if err := os.Remove(originals[0].Name()); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := os.WriteFile(originals[0].Name(), []byte("again"), 0o600); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(originals[0].Name()); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(originals[1].Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestHooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		remove   bool
+		want     string
+		reason   Reason
+		files    uint32
+	}{
+		{"drained", time.Minute, true, "drained", ReasonDrained, 0},
+		{"timeout", 100 * time.Millisecond, false, "timeout", ReasonTimeout, 1},
+	}
+	for _, tt := range tests {
+		testPath := createPath(t)
+		f := createTempFile(t, testPath)
+		var fired []string
+		var got result
+		record := func(name string) func(result) {
+			return func(res result) {
+				fired = append(fired, name)
+				got = res
+			}
+		}
+		opts := newTestOptions(t, tt.deadline, 0, false)
+		opts.hooks = hooks{
+			onStart:     func(initial uint32) { fired = append(fired, fmt.Sprintf("start:%d", initial)) },
+			onDrained:   record("drained"),
+			onTimeout:   record("timeout"),
+			onThreshold: record("threshold"),
+		}
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.remove {
+			time.AfterFunc(50*time.Millisecond, func() { os.Remove(f.Name()) })
+		}
+		res := d.watch(opts)
+		if want := []string{"start:1", tt.want}; !reflect.DeepEqual(fired, want) {
+			t.Errorf("%s: Unexpected result. Wanted hooks: %v, got: %v", tt.name, want, fired)
+		}
+		if got != res || got.reason != tt.reason || got.files != tt.files {
+			t.Errorf("%s: Unexpected result. Wanted the result with reason %d and %d files, got: %+v",
+				tt.name, tt.reason, tt.files, got)
+		}
+	}
+
+	// A watch with no hooks set still runs
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	d, err := newDir(createPath(t), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := d.watch(opts); res.reason != ReasonDrained {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", ReasonDrained, res.reason)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directory permissions are not checked on Windows")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root can remove files from read-only directories")
+	}
+	testPath := createPath(t)
+	createTempFile(t, testPath)
+	if err := os.Chmod(testPath, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(testPath, 0o700) })
+
+	var buf bytes.Buffer
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.checkWritable = true
+	opts.logger = log.New(&buf, "", 0)
+	if _, err := newDir(testPath, opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := "WARNING: files cannot be removed from " + testPath; !strings.Contains(buf.String(), want) {
+		t.Errorf("Unexpected result. Wanted: %q, got: %q", want, buf.String())
+	}
+
+	opts.strictPreflight = true
+	if _, err := newDir(testPath, opts); !errors.Is(err, ErrNotWritable) || !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Unexpected result. Wanted: %s, got: %v", ErrNotWritable, err)
+	}
+
+	// A writable directory passes without a warning
+	buf.Reset()
+	if _, err := newDir(createPath(t), opts); err != nil || buf.Len() > 0 {
+		t.Errorf("Unexpected result. Wanted no error or warning, got: %v, %q", err, buf.String())
+	}
+}
+
+func TestMaxRuntime(t *testing.T) {
+	testPath := createPath(t)
+	var files []*os.File
+	for i := 0; i < 50; i++ {
+		files = append(files, createTempFile(t, testPath))
+	}
+	done := make(chan struct{})
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+		defer close(done)
+
+		// The deadline is extended as files drain, but the runtime cap still ends the watch
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.extendOnProgress = true
+		opts.maxRuntime = 300 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		res := d.watch(opts)
+		if !errors.Is(res.err, ErrMaxRuntime) {
+			t.Fatalf("Unexpected result. Wanted: %s, got: %v", ErrMaxRuntime, res.err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Unexpected result. Wanted the watch to end at the max runtime, got: %s", elapsed)
+		}
+		if got := summaryReason(res); got != ErrMaxRuntime.Error() {
+			t.Errorf("Unexpected result. Wanted: %s, got: %s", ErrMaxRuntime, got)
+		}
+		// Files were still draining when the cap was reached
+		if removed := d.removals(); removed == 0 || res.files == 0 {
+			t.Errorf("Unexpected result. Wanted some files removed and some left, got: %d removed, %d left",
+				removed, res.files)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for _, f := range files {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+}
+
+func TestDerefSymlinks(t *testing.T) {
+	testPath := createPath(t)
+	targets := createPath(t)
+	target := createTempFile(t, targets)
+	file := createTempFile(t, testPath)
+	links := map[string]string{
+		"file-link":     target.Name(),
+		"dir-link":      targets,
+		"dangling-link": filepath.Join(targets, "missing"),
+	}
+	for name, to := range links {
+		if err := os.Symlink(to, filepath.Join(testPath, name)); err != nil {
+			t.Skipf("cannot create symlinks: %s", err)
+		}
+	}
+
+	// By default every symlink counts as a file
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	if got, _, err := readDirFiles(testPath, opts); err != nil || *got != 4 {
+		t.Fatalf("Did not get expected result. Wanted: %d, got: %v, %v", 4, got, err)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, false)
+		opts.derefSymlinks = true
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The symlink to a directory is not a file, and the dangling one is
+		if got := d.count(); got != 3 {
+			t.Fatalf("Did not get expected result. Wanted: %d, got: %d", 3, got)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		if got := d.removals(); got != 3 {
+			t.Errorf("Did not get expected result. Wanted: %d removals, got: %d", 3, got)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// A new symlink to a directory, and the removal of one, do not change the count
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Symlink(targets, filepath.Join(testPath, "new-dir-link")); err != nil {
+			t.Error(err)
+		}
+		for _, name := range []string{"dir-link", "new-dir-link", "file-link", "dangling-link"} {
+			time.Sleep(20 * time.Millisecond)
+			if err := os.Remove(filepath.Join(testPath, name)); err != nil {
+				t.Error(err)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := os.Remove(file.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOlderThan(t *testing.T) {
+	testPath := createPath(t)
+	old := createTempFile(t, testPath)
+	hourAgo := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(old.Name(), hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	aging := createTempFile(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		opts := newTestOptions(t, (1 * time.Minute), 0, true)
+		opts.olderThan = 200 * time.Millisecond
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only the old file counts at the start
+		if got := d.count(); got != 1 {
+			t.Fatalf("Did not get expected result. Wanted: %d, got: %d", 1, got)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		// The file that aged in held up the drain until it was removed, and the fresh one never counted
+		if _, err := os.Stat(aging.Name()); err == nil {
+			t.Errorf("Reported drained before %s, which aged past the cutoff, was removed", aging.Name())
+		}
+		if created, removed := d.totals(); created != 0 || removed != 2 {
+			t.Errorf("Unexpected result. Wanted 0 created and 2 removed, got: %d, %d", created, removed)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// Remove the old file once the other has aged in, alongside a fresh file that will not
+		time.Sleep(400 * time.Millisecond)
+		createTempFile(t, testPath)
+		if err := os.Remove(old.Name()); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if err := os.Remove(aging.Name()); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestOlderThanTouched(t *testing.T) {
+	testPath := createPath(t)
+	touched := createTempFile(t, testPath)
+	hourAgo := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(touched.Name(), hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.olderThan = time.Minute
+	opts.removedGoal = 1
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.count(); got != 1 {
+		t.Fatalf("Did not get expected result. Wanted: %d, got: %d", 1, got)
+	}
+
+	// A write makes the file too new to count, but it was not removed
+	if err := os.WriteFile(touched.Name(), []byte("written again"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.countEvents([]fsnotify.Event{{Name: touched.Name(), Op: fsnotify.Write}}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.count(); got != 0 {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", 0, got)
+	}
+	if _, removed := d.totals(); removed != 0 || d.drained(opts) {
+		t.Errorf("Unexpected result. Wanted nothing removed toward the goal, got: %d removed", removed)
+	}
+}
+
+func TestEventPath(t *testing.T) {
+	testPath := createPath(t)
+	names := []string{"a.csv", "b.csv", "c.csv", "d.csv"}
+	for _, name := range append(names, "skip.tmp") {
+		f, err := os.Create(filepath.Join(testPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	// A baseline keeps the starting files by path, so a remove only counts if its path matches
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.baseline = true
+	opts.exts = []string{".csv"}
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := filepath.Join(t.TempDir(), "overlay2", "l", "diff")
+	burst := []fsnotify.Event{
+		{Name: filepath.Join(testPath, "a.csv"), Op: fsnotify.Remove},
+		{Name: testPath + string(filepath.Separator) + "." + string(filepath.Separator) + "b.csv", Op: fsnotify.Remove},
+		{Name: filepath.Join(layer, "c.csv"), Op: fsnotify.Remove},
+		{Name: "d.csv", Op: fsnotify.Remove},
+		{Name: filepath.Join(layer, "skip.tmp"), Op: fsnotify.Remove},
+	}
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(testPath, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.countEvents(burst, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.count(); got != 0 {
+		t.Errorf("Did not get expected result. Wanted: %d, got: %d", 0, got)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{filepath.Join(testPath, "a.csv"), filepath.Join(testPath, "a.csv")},
+		{filepath.Join(layer, "c.csv"), filepath.Join(testPath, "c.csv")},
+		{"d.csv", filepath.Join(testPath, "d.csv")},
+		{testPath, testPath},
+	}
+	for _, tt := range tests {
+		if got := d.eventPath(tt.name); got != tt.want {
+			t.Errorf("Unexpected result. Wanted: %s, got: %s", tt.want, got)
+		}
+	}
+}
+
+func TestThresholdWarmup(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		// The startup burst would trip a threshold of 2 at once, but is removed within the warmup
+		var stream bytes.Buffer
+		opts := newTestOptions(t, (1 * time.Minute), 2, false)
+		opts.thresholdWarmup = time.Second
+		opts.stream = &stream
+		opts.streamInterval = time.Minute
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		if created, _ := d.totals(); created != 10 {
+			t.Errorf("Did not get expected result. Wanted: %d created, got: %d", 10, created)
+		}
+		// The -json-stream threshold warning is held off by the warmup too
+		if strings.Contains(stream.String(), streamThreshold) {
+			t.Errorf("Unexpected result. Wanted no threshold update during the warmup, got: %q", stream.String())
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		var files []*os.File
+		for i := 0; i < 10; i++ {
+			files = append(files, createTempFile(t, testPath))
+		}
+		time.Sleep(100 * time.Millisecond)
+		for _, f := range files {
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+		for _, file := range []string{file1, file2} {
+			if err := os.Remove(filepath.Join(testPath, file)); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestThresholdWarmupBaseline(t *testing.T) {
+	testPath := createPath(t)
+	createSeedFiles(t, testPath)
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		var stream bytes.Buffer
+		opts := newTestOptions(t, (1 * time.Minute), 2, false)
+		opts.thresholdWarmup = 200 * time.Millisecond
+		opts.stream = &stream
+		opts.streamInterval = time.Minute
+		d, err := newDir(testPath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.watchDrain(opts); !errors.Is(err, ErrTooManyCreateEvents) {
+			t.Fatalf("Unexpected result. Wanted: %s, got: %v", ErrTooManyCreateEvents, err)
+		}
+		// A threshold update, if sampled before the watch stopped, counts only the creates past the baseline
+		scanner := bufio.NewScanner(&stream)
+		for scanner.Scan() {
+			var u streamUpdate
+			if err := json.Unmarshal(scanner.Bytes(), &u); err != nil {
+				t.Fatal(err)
+			}
+			if u.Event == streamThreshold && u.NetCreates > 3 {
+				t.Errorf("Unexpected result. Wanted at most %d net creates past the baseline, got: %d", 3, u.NetCreates)
+			}
+		}
+		// The 10 creates of the warmup became the baseline, so it took 3 more to pass the threshold
+		if created, _ := d.totals(); created != 13 {
+			t.Errorf("Did not get expected result. Wanted: %d created, got: %d", 13, created)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		for i := 0; i < 10; i++ {
+			createTempFile(t, testPath)
+		}
+		time.Sleep(300 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			createTempFile(t, testPath)
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
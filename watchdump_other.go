@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyWatchDump does nothing, since this platform has no SIGUSR1 to ask for a dump of the active watches
+func notifyWatchDump(c chan<- os.Signal) {}
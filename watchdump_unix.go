@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyWatchDump relays SIGUSR1, which asks for a dump of the active watches, to c
+func notifyWatchDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
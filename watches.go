@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// activeWatches holds the dirs with a live watcher, along with their options, for dumpWatches
+var activeWatches = struct {
+	sync.Mutex
+	dirs map[*dir]*options
+}{dirs: make(map[*dir]*options)}
+
+// trackWatches adds d to activeWatches and returns a func that removes it, for when the watch ends
+func trackWatches(d *dir, opt *options) func() {
+	activeWatches.Lock()
+	defer activeWatches.Unlock()
+	activeWatches.dirs[d] = opt
+	return func() {
+		activeWatches.Lock()
+		defer activeWatches.Unlock()
+		delete(activeWatches.dirs, d)
+	}
+}
+
+// watchStatus describes a path added to the watcher
+type watchStatus struct {
+	Path  string
+	Files int // Files counts the files directly in Path, or is -1 if Path could not be read
+}
+
+// watchList returns the paths d has added to its watcher, sorted, each with its own file count read now
+func (d *dir) watchList(opt *options) []watchStatus {
+	d.mu.RLock()
+	paths := make([]string, 0, len(d.watched))
+	for path := range d.watched {
+		paths = append(paths, path)
+	}
+	d.mu.RUnlock()
+	sort.Strings(paths)
+
+	list := make([]watchStatus, 0, len(paths))
+	for _, path := range paths {
+		list = append(list, watchStatus{Path: path, Files: countFilesIn(path, opt)})
+	}
+	return list
+}
+
+// countFilesIn counts the files directly in a directory that count for opt, or returns -1 if it cannot be read
+func countFilesIn(dirName string, opt *options) int {
+	d, err := os.Open(dirName)
+	if err != nil {
+		return -1
+	}
+	defer d.Close()
+	n := 0
+	err = eachDirEntry(d, func(entry fs.DirEntry) error {
+		if opt.counts(dirName, entry) && !(opt.recursive && opt.pruned(filepath.Join(dirName, entry.Name()))) {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// dumpWatches writes the paths every active watch has added to its watcher, with their file counts,
+// one line per path, grouped by the watched directory. Each group also has a line with the created and removed
+// totals and the net creates, against the fileCreates threshold if one is set.
+func dumpWatches(w io.Writer) {
+	activeWatches.Lock()
+	dirs := make([]*dir, 0, len(activeWatches.dirs))
+	opts := make(map[*dir]*options, len(activeWatches.dirs))
+	for d, opt := range activeWatches.dirs {
+		dirs = append(dirs, d)
+		opts[d] = opt
+	}
+	activeWatches.Unlock()
+	sort.Slice(dirs, func(i, j int) bool { return *dirs[i].dirName < *dirs[j].dirName })
+
+	for _, d := range dirs {
+		list := d.watchList(opts[d])
+		fmt.Fprintf(w, "WATCHES: %s has %d watches and %d files\n", *d.dirName, len(list), d.count())
+		creates, removes, net := d.netCreates()
+		threshold := ""
+		if opts[d].fileCreates > 0 {
+			threshold = fmt.Sprintf(" threshold:%d", opts[d].fileCreates)
+		}
+		fmt.Fprintf(w, "  creates:%d removes:%d net:%d%s\n", creates, removes, net, threshold)
+		for _, ws := range list {
+			if ws.Files < 0 {
+				fmt.Fprintf(w, "  %s files:unreadable\n", ws.Path)
+			} else {
+				fmt.Fprintf(w, "  %s files:%d\n", ws.Path, ws.Files)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchList(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+	gone := filepath.Join(testPath, "gone")
+	if err := os.Mkdir(gone, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	added := filepath.Join(testPath, "added")
+	opts := newTestOptions(t, (1 * time.Minute), 0, false)
+	opts.recursive = true
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+		// The watch is no longer active once it ends
+		var buf bytes.Buffer
+		dumpWatches(&buf)
+		if strings.Contains(buf.String(), testPath) {
+			t.Errorf("Unexpected result. Wanted no active watch for %s, got: %q", testPath, buf.String())
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		time.Sleep(50 * time.Millisecond)
+		// A subdirectory comes and another goes while watching
+		if err := os.Mkdir(added, 0o700); err != nil {
+			t.Error(err)
+		}
+		f := createTempFile(t, added)
+		if err := os.Remove(gone); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		want := []watchStatus{{Path: testPath, Files: 1}, {Path: added, Files: 1}, {Path: filepath.Join(testPath, sub)}}
+		if got := d.watchList(opts); !reflect.DeepEqual(got, want) {
+			t.Errorf("Unexpected result. Wanted: %v, got: %v", want, got)
+		}
+		var buf bytes.Buffer
+		dumpWatches(&buf)
+		for _, line := range []string{"WATCHES: " + testPath + " has 3 watches and 2 files\n", "  " + added + " files:1\n"} {
+			if !strings.Contains(buf.String(), line) {
+				t.Errorf("Unexpected result. Wanted a line %q, got: %q", line, buf.String())
+			}
+		}
+
+		for _, name := range []string{seed.Name(), f.Name()} {
+			if err := os.Remove(name); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
+
+func TestDumpWatchesNetCreates(t *testing.T) {
+	testPath := createPath(t)
+	seed := createTempFile(t, testPath)
+	opts := newTestOptions(t, (1 * time.Minute), 100, false)
+	d, err := newDir(testPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Watch", func(t *testing.T) {
+		t.Parallel()
+
+		if drained, err := d.watchDrain(opts); !drained || err != nil {
+			t.Fatalf("Unexpected result. Wanted: drained, got: %t, %v", drained, err)
+		}
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		t.Parallel()
+
+		// Five creates and two removes, far from the threshold
+		time.Sleep(50 * time.Millisecond)
+		var files []*os.File
+		for i := 0; i < 5; i++ {
+			files = append(files, createTempFile(t, testPath))
+		}
+		for _, f := range files[:2] {
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		var buf bytes.Buffer
+		dumpWatches(&buf)
+		if line := "  creates:5 removes:2 net:3 threshold:100\n"; !strings.Contains(buf.String(), line) {
+			t.Errorf("Unexpected result. Wanted a line %q, got: %q", line, buf.String())
+		}
+
+		for _, f := range append(files[2:], seed) {
+			if err := os.Remove(f.Name()); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// Access modes for syscall.Access, which does not name them
+const (
+	accessWrite  = 0x2 // W_OK
+	accessSearch = 0x1 // X_OK
+)
+
+// canRemoveFrom reports whether the process may remove entries from a directory, which takes write and search
+// permission on it, along with the reason if not
+func canRemoveFrom(dirName string) (bool, error) {
+	if err := syscall.Access(dirName, accessWrite|accessSearch); err != nil {
+		return false, err
+	}
+	return true, nil
+}